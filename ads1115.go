@@ -0,0 +1,335 @@
+/*
+	Copyright (c) 2016 Christopher Young
+	Distributable under the terms of The "BSD New"" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	ads1115.go: ADS1115 16-bit ADC driver, also used for the 12-bit ADS1015 (same registers,
+		faster data rates). Typed config register fields, written as a whole and read back to verify.
+
+	Ref: http://www.ti.com/lit/ds/symlink/ads1115.pdf
+	Ref: https://github.com/jrowberg/i2cdevlib/blob/master/Arduino/ADS1115/ADS1115.h
+*/
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	ADS_ADDR_MIN = 0x48 // ADDR pin to GND.
+	ADS_ADDR_MAX = 0x4B // ADDR pin to SCL.
+
+	ADS_REG_CONVERSION = 0x00
+	ADS_REG_CONFIG     = 0x01
+	ADS_REG_LO_THRESH  = 0x02
+	ADS_REG_HI_THRESH  = 0x03
+
+	// Config register. Written: start a single-shot conversion. Read: 1 = idle, 0 = converting.
+	ADS_CONFIG_OS = 0x8000
+)
+
+// Config register bits 7:5, samples per second. Names are the ADS1115 rates.
+type adsRate uint16
+
+const (
+	ADS_RATE_8 adsRate = iota
+	ADS_RATE_16
+	ADS_RATE_32
+	ADS_RATE_64
+	ADS_RATE_128
+	ADS_RATE_250
+	ADS_RATE_475
+	ADS_RATE_860
+)
+
+var (
+	ads1115RateSPS = [8]int{8, 16, 32, 64, 128, 250, 475, 860}
+	ads1015RateSPS = [8]int{128, 250, 490, 920, 1600, 2400, 3300, 3300}
+)
+
+// Config register bits 11:9, full scale range.
+type adsGain uint16
+
+const (
+	ADS_PGA_6144 adsGain = iota // +/-6.144V.
+	ADS_PGA_4096                // +/-4.096V.
+	ADS_PGA_2048                // +/-2.048V.
+	ADS_PGA_1024                // +/-1.024V.
+	ADS_PGA_512                 // +/-0.512V.
+	ADS_PGA_256                 // +/-0.256V.
+)
+
+// Full scale range by gain, units=mV. Codes 6 and 7 are also +/-0.256V.
+var adsFullScaleMillivolts = [...]float64{6144, 4096, 2048, 1024, 512, 256, 256, 256}
+
+func (g adsGain) fullScale() float64 {
+	return adsFullScaleMillivolts[g&0x07]
+}
+
+// Conversion register (16-bit two's complement) to mV. One LSB is fullScale/32768: 187.5uV at
+// +/-6.144V, 7.8125uV at +/-0.256V. The ADS1015 result is left-justified with the low 4 bits
+// zero, so the same scaling applies.
+func (g adsGain) millivolts(v uint16) float64 {
+	return float64(int16(v)) * g.fullScale() / float64(32768.0)
+}
+
+// Gain for a full scale range in mV (6144, 4096, ...).
+func adsGainFor(mv int) (adsGain, bool) {
+	for g := ADS_PGA_6144; g <= ADS_PGA_256; g++ {
+		if int(g.fullScale()) == mv {
+			return g, true
+		}
+	}
+	return 0, false
+}
+
+// Config register bits 14:12, input selection.
+type adsMux uint16
+
+const (
+	ADS_MUX_P0_N1 adsMux = iota // Differential A0-A1.
+	ADS_MUX_P0_N3
+	ADS_MUX_P1_N3
+	ADS_MUX_P2_N3
+	ADS_MUX_P0_NG // Single ended A0.
+	ADS_MUX_P1_NG
+	ADS_MUX_P2_NG
+	ADS_MUX_P3_NG
+)
+
+// Single-ended mux setting for input 0-3.
+func adsMuxSingle(channel int) adsMux {
+	return ADS_MUX_P0_NG + adsMux(channel&0x03)
+}
+
+// Config register bit 8.
+type adsMode uint16
+
+const (
+	ADS_MODE_CONTINUOUS adsMode = iota
+	ADS_MODE_SINGLESHOT
+)
+
+// Config register bits 1:0, conversions beyond threshold before ALERT/RDY asserts.
+type adsCompQueue uint16
+
+const (
+	ADS_COMP_QUEUE_1 adsCompQueue = iota
+	ADS_COMP_QUEUE_2
+	ADS_COMP_QUEUE_4
+	ADS_COMP_QUEUE_DISABLE
+)
+
+// Config register bits 4:0.
+type adsComparator struct {
+	Window     bool // Window comparator, otherwise traditional.
+	ActiveHigh bool // ALERT/RDY polarity.
+	Latching   bool
+	Queue      adsCompQueue
+}
+
+type adsConfig struct {
+	Rate       adsRate
+	Gain       adsGain
+	Mux        adsMux
+	Mode       adsMode
+	Comparator adsComparator
+}
+
+// Config register value, OS bit clear.
+func (c adsConfig) word() uint16 {
+	w := uint16(c.Mux&0x07)<<12 | uint16(c.Gain&0x07)<<9 | uint16(c.Mode&0x01)<<8 | uint16(c.Rate&0x07)<<5 | uint16(c.Comparator.Queue&0x03)
+	if c.Comparator.Window {
+		w |= 1 << 4
+	}
+	if c.Comparator.ActiveHigh {
+		w |= 1 << 3
+	}
+	if c.Comparator.Latching {
+		w |= 1 << 2
+	}
+	return w
+}
+
+func parseADSConfig(w uint16) adsConfig {
+	return adsConfig{
+		Rate: adsRate(w>>5) & 0x07,
+		Gain: adsGain(w>>9) & 0x07,
+		Mux:  adsMux(w>>12) & 0x07,
+		Mode: adsMode(w>>8) & 0x01,
+		Comparator: adsComparator{
+			Window:     w&(1<<4) != 0,
+			ActiveHigh: w&(1<<3) != 0,
+			Latching:   w&(1<<2) != 0,
+			Queue:      adsCompQueue(w) & 0x03,
+		},
+	}
+}
+
+// The part of embd.I2CBus the driver uses.
+type i2cBus interface {
+	ReadWordFromReg(addr, reg byte) (uint16, error)
+	WriteWordToReg(addr, reg byte, value uint16) error
+	Close() error
+}
+
+type ads1115 struct {
+	bus   i2cBus
+	addr  byte
+	model string // "ads1115" or "ads1015", for messages.
+	sps   *[8]int
+	cfg   adsConfig // Last config written.
+	mu    *sync.Mutex
+}
+
+func newADS1x15(bus i2cBus, addr byte, model string, sps *[8]int) (*ads1115, error) {
+	if addr < ADS_ADDR_MIN || addr > ADS_ADDR_MAX {
+		return nil, fmt.Errorf("invalid %s address 0x%02x", model, addr)
+	}
+	return &ads1115{bus: bus, addr: addr, model: model, sps: sps, mu: &sync.Mutex{}}, nil
+}
+
+func newADS1115(bus i2cBus, addr byte) (*ads1115, error) {
+	return newADS1x15(bus, addr, "ads1115", &ads1115RateSPS)
+}
+
+func newADS1015(bus i2cBus, addr byte) (*ads1115, error) {
+	return newADS1x15(bus, addr, "ads1015", &ads1015RateSPS)
+}
+
+// Time for one conversion.
+func (d *ads1115) period(r adsRate) time.Duration {
+	return time.Second / time.Duration(d.sps[r&0x07])
+}
+
+func (d *ads1115) writeConfig(cfg adsConfig) error {
+	w := cfg.word()
+	if err := d.bus.WriteWordToReg(d.addr, ADS_REG_CONFIG, w); err != nil {
+		return fmt.Errorf("%s 0x%02x: write config: %s", d.model, d.addr, err.Error())
+	}
+	r, err := d.bus.ReadWordFromReg(d.addr, ADS_REG_CONFIG)
+	if err != nil {
+		return fmt.Errorf("%s 0x%02x: read config: %s", d.model, d.addr, err.Error())
+	}
+	if r&^ADS_CONFIG_OS != w {
+		return fmt.Errorf("%s 0x%02x: config read back 0x%04x, wrote 0x%04x", d.model, d.addr, r&^ADS_CONFIG_OS, w)
+	}
+	d.cfg = cfg
+	return nil
+}
+
+// Write and verify the config register.
+func (d *ads1115) configure(cfg adsConfig) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.writeConfig(cfg)
+}
+
+func (d *ads1115) config() adsConfig {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.cfg
+}
+
+// Turn ALERT/RDY into a conversion-ready signal: Hi_thresh MSB set, Lo_thresh MSB clear. The
+// comparator also has to be enabled (Queue other than ADS_COMP_QUEUE_DISABLE). In continuous mode
+// the pin then pulses at the end of every conversion.
+func (d *ads1115) enableReady() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, r := range []struct {
+		reg byte
+		val uint16
+	}{{ADS_REG_HI_THRESH, 0x8000}, {ADS_REG_LO_THRESH, 0x0000}} {
+		if err := d.bus.WriteWordToReg(d.addr, r.reg, r.val); err != nil {
+			return fmt.Errorf("%s 0x%02x: write threshold: %s", d.model, d.addr, err.Error())
+		}
+		v, err := d.bus.ReadWordFromReg(d.addr, r.reg)
+		if err != nil {
+			return fmt.Errorf("%s 0x%02x: read threshold: %s", d.model, d.addr, err.Error())
+		}
+		if v != r.val {
+			return fmt.Errorf("%s 0x%02x: threshold 0x%02x read back 0x%04x, wrote 0x%04x", d.model, d.addr, r.reg, v, r.val)
+		}
+	}
+	return nil
+}
+
+// Latest conversion result. In continuous mode.
+func (d *ads1115) readConversion() (uint16, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.bus.ReadWordFromReg(d.addr, ADS_REG_CONVERSION)
+}
+
+// Start a single-shot conversion and wait for the OS bit to report it done.
+func (d *ads1115) convert() (uint16, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.convertLocked()
+}
+
+func (d *ads1115) convertLocked() (uint16, error) {
+	if d.cfg.Mode != ADS_MODE_SINGLESHOT {
+		return 0, fmt.Errorf("%s 0x%02x: not in single-shot mode", d.model, d.addr)
+	}
+	if err := d.bus.WriteWordToReg(d.addr, ADS_REG_CONFIG, d.cfg.word()|ADS_CONFIG_OS); err != nil {
+		return 0, err
+	}
+
+	period := d.period(d.cfg.Rate)
+	deadline := time.Now().Add(4 * period)
+	for {
+		time.Sleep(period / 4)
+		r, err := d.bus.ReadWordFromReg(d.addr, ADS_REG_CONFIG)
+		if err != nil {
+			return 0, err
+		}
+		if r&ADS_CONFIG_OS != 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			return 0, fmt.Errorf("%s 0x%02x: conversion timed out", d.model, d.addr)
+		}
+	}
+	return d.bus.ReadWordFromReg(d.addr, ADS_REG_CONVERSION)
+}
+
+// One conversion from another input, then back to the configured mux. In continuous mode the
+// first result after a mux change is only valid two periods later.
+func (d *ads1115) readMux(mux adsMux) (uint16, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	orig := d.cfg
+	cfg := orig
+	cfg.Mux = mux
+	if err := d.writeConfig(cfg); err != nil {
+		return 0, err
+	}
+	var v uint16
+	var err error
+	if cfg.Mode == ADS_MODE_SINGLESHOT {
+		v, err = d.convertLocked()
+	} else {
+		time.Sleep(2 * d.period(cfg.Rate))
+		v, err = d.bus.ReadWordFromReg(d.addr, ADS_REG_CONVERSION)
+	}
+	if rerr := d.writeConfig(orig); rerr != nil && err == nil {
+		err = rerr
+	}
+	if orig.Mode == ADS_MODE_CONTINUOUS {
+		time.Sleep(2 * d.period(orig.Rate))
+	}
+	return v, err
+}
+
+func (d *ads1115) close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.bus.Close()
+}
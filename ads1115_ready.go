@@ -0,0 +1,67 @@
+/*
+	Copyright (c) 2016 Christopher Young
+	Distributable under the terms of The "BSD New"" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	ads1115_ready.go: ADS1115 ALERT/RDY pin on a GPIO, so the flow input is read once per
+		conversion instead of polled on a timer.
+*/
+
+package main
+
+import (
+	"github.com/kidoman/embd"
+	"time"
+)
+
+const (
+	ADS_READY_TIMEOUT  = 100 * time.Millisecond // No edge for this long: fall back to timed polling.
+	ADS_READY_GPIO_OFF = -1
+)
+
+type adsReady struct {
+	pin   embd.DigitalPin
+	ready chan time.Time // Edges not yet consumed; at most one is held.
+}
+
+// Watch ALERT/RDY (active low, open drain, needs a pull-up) on the given GPIO.
+func openADSReady(gpio int) (*adsReady, error) {
+	pin, err := embd.NewDigitalPin(gpio)
+	if err != nil {
+		return nil, err
+	}
+	if err := pin.SetDirection(embd.In); err != nil {
+		pin.Close()
+		return nil, err
+	}
+
+	r := &adsReady{pin: pin, ready: make(chan time.Time, 1)}
+	err = pin.Watch(embd.EdgeFalling, func(embd.DigitalPin) {
+		select {
+		case r.ready <- time.Now():
+		default:
+			// Previous conversion not read yet.
+		}
+	})
+	if err != nil {
+		pin.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// Wait for the next conversion, and return when it completed. False on timeout.
+func (r *adsReady) wait(timeout time.Duration) (time.Time, bool) {
+	select {
+	case t := <-r.ready:
+		return t, true
+	case <-time.After(timeout):
+		return time.Time{}, false
+	}
+}
+
+func (r *adsReady) close() error {
+	r.pin.StopWatching()
+	return r.pin.Close()
+}
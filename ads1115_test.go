@@ -0,0 +1,333 @@
+/*
+	Copyright (c) 2016 Christopher Young
+	Distributable under the terms of The "BSD New"" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	ads1115_test.go: ADS1115/ADS1015 driver against a simulated I2C bus.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// In-memory I2C bus emulating ADS1115 registers. Conversions complete instantly.
+type fakeI2CBus struct {
+	regs map[byte]*[4]uint16 // By device address.
+	// Produces the next conversion result for a device, given its current config register.
+	convert func(addr byte, cfg uint16) uint16
+	// Bits of each register that ignore writes and keep their reset value (a clone, or a stuck bus).
+	stuck [4]uint16
+	// Fail this many upcoming transactions.
+	failNext int
+	// Fail this many upcoming conversion register reads.
+	failConversions int
+	closed          bool
+	mu              *sync.Mutex
+}
+
+var errFakeI2C = errors.New("fake i2c: transaction failed")
+
+// ADS1115 power-on config register: single-shot, +/-2.048V, 128 SPS, comparator disabled.
+const ADS_CONFIG_RESET = 0x8583
+
+// Power-on register values.
+var adsResetRegs = [4]uint16{ADS_REG_CONFIG: ADS_CONFIG_RESET, ADS_REG_LO_THRESH: 0x8000, ADS_REG_HI_THRESH: 0x7FFF}
+
+func newFakeI2CBus(convert func(addr byte, cfg uint16) uint16, addrs ...byte) *fakeI2CBus {
+	b := &fakeI2CBus{regs: make(map[byte]*[4]uint16), convert: convert, mu: &sync.Mutex{}}
+	for _, a := range addrs {
+		r := adsResetRegs
+		b.regs[a] = &r
+	}
+	return b
+}
+
+func (b *fakeI2CBus) device(addr, reg byte) (*[4]uint16, error) {
+	if b.closed {
+		return nil, errors.New("fake i2c: bus closed")
+	}
+	if b.failNext > 0 {
+		b.failNext--
+		return nil, errFakeI2C
+	}
+	r, ok := b.regs[addr]
+	if !ok {
+		return nil, fmt.Errorf("fake i2c: no device at 0x%02x", addr)
+	}
+	if reg > ADS_REG_HI_THRESH {
+		return nil, fmt.Errorf("fake i2c: no register 0x%02x", reg)
+	}
+	return r, nil
+}
+
+func (b *fakeI2CBus) ReadWordFromReg(addr, reg byte) (uint16, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	r, err := b.device(addr, reg)
+	if err != nil {
+		return 0, err
+	}
+	if reg == ADS_REG_CONVERSION && b.failConversions > 0 {
+		b.failConversions--
+		return 0, errFakeI2C
+	}
+	// Continuous mode: a fresh result on every read.
+	if reg == ADS_REG_CONVERSION && r[ADS_REG_CONFIG]&(1<<8) == 0 && b.convert != nil {
+		r[ADS_REG_CONVERSION] = b.convert(addr, r[ADS_REG_CONFIG])
+	}
+	return r[reg], nil
+}
+
+func (b *fakeI2CBus) WriteWordToReg(addr, reg byte, value uint16) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	r, err := b.device(addr, reg)
+	if err != nil {
+		return err
+	}
+	value = value&^b.stuck[reg] | adsResetRegs[reg]&b.stuck[reg]
+	switch reg {
+	case ADS_REG_CONVERSION:
+		return errors.New("fake i2c: conversion register is read-only")
+	case ADS_REG_CONFIG:
+		// Single-shot start.
+		if value&ADS_CONFIG_OS != 0 && value&(1<<8) != 0 && b.convert != nil {
+			r[ADS_REG_CONVERSION] = b.convert(addr, value&^ADS_CONFIG_OS)
+		}
+		r[reg] = value | ADS_CONFIG_OS // Always idle.
+	default:
+		r[reg] = value
+	}
+	return nil
+}
+
+func (b *fakeI2CBus) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	return nil
+}
+
+// Conversion result identifying the mux it was taken from.
+func fakeConvertByMux(addr byte, cfg uint16) uint16 {
+	return 0x1000 + uint16(parseADSConfig(cfg).Mux)
+}
+
+func TestADSConfigWord(t *testing.T) {
+	cfg := adsConfig{
+		Rate:       ADS_RATE_860,
+		Gain:       ADS_PGA_4096,
+		Mux:        ADS_MUX_P3_NG,
+		Mode:       ADS_MODE_SINGLESHOT,
+		Comparator: adsComparator{Window: true, Latching: true, Queue: ADS_COMP_QUEUE_4},
+	}
+	// MUX 111, PGA 001, MODE 1, DR 111, COMP_MODE 1, COMP_POL 0, COMP_LAT 1, COMP_QUE 10.
+	if w := cfg.word(); w != 0x73F6 {
+		t.Errorf("word() = 0x%04x, want 0x73f6", w)
+	}
+	if got := parseADSConfig(cfg.word() | ADS_CONFIG_OS); got != cfg {
+		t.Errorf("parseADSConfig() = %+v, want %+v", got, cfg)
+	}
+	if got := parseADSConfig(ADS_CONFIG_RESET); got.Gain != ADS_PGA_2048 || got.Mode != ADS_MODE_SINGLESHOT || got.Comparator.Queue != ADS_COMP_QUEUE_DISABLE {
+		t.Errorf("reset config parsed as %+v", got)
+	}
+}
+
+func TestADSConfigure(t *testing.T) {
+	bus := newFakeI2CBus(fakeConvertByMux, 0x49)
+	if _, err := newADS1115(bus, 0x47); err == nil {
+		t.Error("address 0x47 accepted")
+	}
+	d, err := newADS1115(bus, 0x49)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.configure(adsFlowConfig); err != nil {
+		t.Fatal(err)
+	}
+	if d.config() != adsFlowConfig || bus.regs[0x49][ADS_REG_CONFIG]&^ADS_CONFIG_OS != adsFlowConfig.word() {
+		t.Errorf("config not written: 0x%04x", bus.regs[0x49][ADS_REG_CONFIG])
+	}
+
+	// Comparator queue bits don't take: the read back catches it and the last good config stays.
+	bus.stuck[ADS_REG_CONFIG] = 0x0003
+	cfg := adsFlowConfig
+	cfg.Comparator.Queue = ADS_COMP_QUEUE_1
+	if err := d.configure(cfg); err == nil {
+		t.Error("config read back mismatch not reported")
+	}
+	if d.config() != adsFlowConfig {
+		t.Errorf("config() = %+v after a failed configure", d.config())
+	}
+	bus.stuck[ADS_REG_CONFIG] = 0
+
+	bus.failNext = 1
+	if err := d.configure(cfg); err == nil {
+		t.Error("bus error not reported")
+	}
+	if err := d.configure(cfg); err != nil {
+		t.Errorf("configure after a bus error: %s", err.Error())
+	}
+}
+
+func TestADSEnableReady(t *testing.T) {
+	bus := newFakeI2CBus(fakeConvertByMux, ADS_ADDR_MIN)
+	d, _ := newADS1115(bus, ADS_ADDR_MIN)
+	if err := d.enableReady(); err != nil {
+		t.Fatal(err)
+	}
+	r := bus.regs[ADS_ADDR_MIN]
+	if r[ADS_REG_HI_THRESH] != 0x8000 || r[ADS_REG_LO_THRESH] != 0x0000 {
+		t.Errorf("thresholds hi 0x%04x lo 0x%04x", r[ADS_REG_HI_THRESH], r[ADS_REG_LO_THRESH])
+	}
+
+	// Hi_thresh stuck at its reset value: still a comparator, not a ready signal.
+	bus = newFakeI2CBus(fakeConvertByMux, ADS_ADDR_MIN)
+	bus.stuck[ADS_REG_HI_THRESH] = 0xFFFF
+	d, _ = newADS1115(bus, ADS_ADDR_MIN)
+	if err := d.enableReady(); err == nil {
+		t.Error("threshold read back mismatch not reported")
+	}
+}
+
+func TestADSReadMux(t *testing.T) {
+	for _, mode := range []adsMode{ADS_MODE_CONTINUOUS, ADS_MODE_SINGLESHOT} {
+		bus := newFakeI2CBus(fakeConvertByMux, ADS_ADDR_MIN)
+		d, _ := newADS1115(bus, ADS_ADDR_MIN)
+		cfg := adsFlowConfig
+		cfg.Mode = mode
+		if err := d.configure(cfg); err != nil {
+			t.Fatal(err)
+		}
+
+		v, err := d.readMux(adsMuxSingle(3))
+		if err != nil || v != 0x1000+uint16(ADS_MUX_P3_NG) {
+			t.Errorf("mode %d: readMux() = 0x%04x, %v", mode, v, err)
+		}
+		if d.config() != cfg || parseADSConfig(bus.regs[ADS_ADDR_MIN][ADS_REG_CONFIG]) != cfg {
+			t.Errorf("mode %d: mux not restored, config 0x%04x", mode, bus.regs[ADS_ADDR_MIN][ADS_REG_CONFIG])
+		}
+		if mode == ADS_MODE_CONTINUOUS {
+			if v, _ := d.readConversion(); v != 0x1000+uint16(ADS_MUX_P0_N1) {
+				t.Errorf("flow input reads 0x%04x after readMux()", v)
+			}
+		}
+
+		// A failed conversion still puts the flow input back.
+		bus.failConversions = 1
+		if _, err := d.readMux(adsMuxSingle(2)); err == nil {
+			t.Errorf("mode %d: conversion error not returned", mode)
+		}
+		if parseADSConfig(bus.regs[ADS_ADDR_MIN][ADS_REG_CONFIG]) != cfg {
+			t.Errorf("mode %d: mux not restored after an error", mode)
+		}
+	}
+}
+
+func TestADSConvertNeedsSingleShot(t *testing.T) {
+	bus := newFakeI2CBus(fakeConvertByMux, ADS_ADDR_MIN)
+	d, _ := newADS1015(bus, ADS_ADDR_MIN)
+	if err := d.configure(adsFlowConfig); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.convert(); err == nil {
+		t.Error("convert() in continuous mode")
+	}
+	if p := d.period(ADS_RATE_860); p != 303030 {
+		t.Errorf("ADS1015 period at the top rate %s, want 303.03us", p)
+	}
+}
+
+func TestADSGainMillivolts(t *testing.T) {
+	tests := []struct {
+		gain adsGain
+		code uint16 // Config register bits 11:9.
+		fsr  int    // units=mV.
+		lsb  float64
+	}{
+		{ADS_PGA_6144, 0x0000, 6144, 0.1875},
+		{ADS_PGA_4096, 0x0200, 4096, 0.125},
+		{ADS_PGA_2048, 0x0400, 2048, 0.0625},
+		{ADS_PGA_1024, 0x0600, 1024, 0.03125},
+		{ADS_PGA_512, 0x0800, 512, 0.015625},
+		{ADS_PGA_256, 0x0A00, 256, 0.0078125},
+		{6, 0x0C00, 256, 0.0078125},
+		{7, 0x0E00, 256, 0.0078125},
+	}
+	for _, tt := range tests {
+		if w := (adsConfig{Gain: tt.gain}).word(); w != tt.code {
+			t.Errorf("gain %d: config word 0x%04x, want PGA bits 0x%04x", tt.gain, w, tt.code)
+		}
+		if g := parseADSConfig(tt.code).Gain; g != tt.gain {
+			t.Errorf("PGA bits 0x%04x parsed as gain %d, want %d", tt.code, g, tt.gain)
+		}
+
+		fs := float64(tt.fsr)
+		for _, c := range []struct {
+			v    uint16
+			want float64
+		}{
+			{0x0000, 0},
+			{0x0001, tt.lsb},
+			{0xFFFF, -tt.lsb},
+			{0x4000, fs / 2},
+			{0x7FFF, fs - tt.lsb},
+			{0x8000, -fs},
+			{0xC000, -fs / 2},
+		} {
+			if mv := tt.gain.millivolts(c.v); mv != c.want {
+				t.Errorf("gain %d: millivolts(0x%04x) = %g, want %g", tt.gain, c.v, mv, c.want)
+			}
+		}
+	}
+}
+
+// ADS1015: 12-bit result in bits 15:4, so one LSB is 16 ADS1115 LSBs.
+func TestADS1015Millivolts(t *testing.T) {
+	tests := []struct {
+		gain adsGain
+		v    int16 // 12-bit result.
+		want float64
+	}{
+		{ADS_PGA_6144, 2047, 6141},
+		{ADS_PGA_6144, 1, 3},
+		{ADS_PGA_6144, -2048, -6144},
+		{ADS_PGA_4096, 2047, 4094},
+		{ADS_PGA_4096, -1, -2},
+		{ADS_PGA_2048, 1000, 1000},
+		{ADS_PGA_2048, -2048, -2048},
+		{ADS_PGA_1024, 2047, 1023.5},
+		{ADS_PGA_512, 1, 0.25},
+		{ADS_PGA_256, 2047, 255.875},
+		{ADS_PGA_256, -2048, -256},
+	}
+	for _, tt := range tests {
+		v := uint16(tt.v) << 4
+		if mv := tt.gain.millivolts(v); mv != tt.want {
+			t.Errorf("gain %d: millivolts(0x%04x) = %g, want %g", tt.gain, v, mv, tt.want)
+		}
+	}
+}
+
+func TestADSGainFor(t *testing.T) {
+	for mv, want := range map[int]adsGain{6144: ADS_PGA_6144, 4096: ADS_PGA_4096, 2048: ADS_PGA_2048, 1024: ADS_PGA_1024, 512: ADS_PGA_512, 256: ADS_PGA_256} {
+		if g, ok := adsGainFor(mv); !ok || g != want {
+			t.Errorf("adsGainFor(%d) = %d, %v, want %d", mv, g, ok, want)
+		}
+		if g, _ := adsGainFor(mv); int(g.fullScale()) != mv {
+			t.Errorf("adsGainFor(%d) full scale %g", mv, g.fullScale())
+		}
+	}
+	for _, mv := range []int{0, -2048, 5000, 6143, 128, 8192} {
+		if g, ok := adsGainFor(mv); ok {
+			t.Errorf("adsGainFor(%d) = %d, want none", mv, g)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+/*
+	Copyright (c) 2016 Christopher Young
+	Distributable under the terms of The "BSD New"" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	alerts.go: Fuel remaining, endurance and alert evaluation.
+*/
+
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	ALERT_LEVEL_CAUTION = "caution"
+	ALERT_LEVEL_WARNING = "warning"
+)
+
+type Alert struct {
+	Name    string // Short identifier, e.g. "LOW_FUEL".
+	Level   string // ALERT_LEVEL_CAUTION or ALERT_LEVEL_WARNING.
+	Message string
+}
+
+// Sent on the event stream when an alert is raised or cleared.
+type alertEvent struct {
+	Time   time.Time
+	Active bool
+	Alert  Alert
+}
+
+func findAlert(alerts []Alert, name string) bool {
+	for _, a := range alerts {
+		if a.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Publish an event for each alert raised or cleared between prev and cur.
+func publishAlertChanges(prev, cur []Alert, t time.Time) {
+	for _, a := range cur {
+		if !findAlert(prev, a.Name) {
+			logger.Warningf("alert: %s\n", a.Message)
+			events.publish(EVENT_TYPE_ALERT, alertEvent{Time: t, Active: true, Alert: a}, true)
+		}
+	}
+	for _, a := range prev {
+		if !findAlert(cur, a.Name) {
+			logger.Debugf("alert cleared: %s\n", a.Name)
+			events.publish(EVENT_TYPE_ALERT, alertEvent{Time: t, Active: false, Alert: a}, true)
+		}
+	}
+}
+
+// Set the fuel on board. Burn from this point on is subtracted from it. Caller holds flow.mu.
+func setFuelOnBoard(gallons float64) {
+	flow.Fuel_Start = gallons
+	flow.fuel_start_raw = flow.flow_total_raw
+	logger.Debugf("fuel on board set to %0.1f gal.\n", gallons)
+}
+
+// Update Fuel_Remaining and Endurance_Minutes from the current totals. Caller holds flow.mu.
+func updateFuelRemaining() {
+	burned := float64(flow.flow_total_raw-flow.fuel_start_raw) * gallonsPerClick()
+	flow.Fuel_Remaining = flow.Fuel_Start - burned
+	if flow.Fuel_Remaining < 0 {
+		flow.Fuel_Remaining = 0
+	}
+
+	// Endurance from the last minute's burn rate, -1 when not burning.
+	flow.Endurance_Minutes = -1
+	if flow.Flow_LastMinute_GPH > 0 {
+		flow.Endurance_Minutes = flow.Fuel_Remaining / flow.Flow_LastMinute_GPH * float64(60.0)
+	}
+}
+
+// Evaluate the alert conditions against the current stats. Caller holds flow.mu.
+func checkAlerts() []Alert {
+	alerts := make([]Alert, 0)
+
+	if flow.Fuel_Remaining <= 0 {
+		alerts = append(alerts, Alert{Name: "FUEL_EXHAUSTED", Level: ALERT_LEVEL_WARNING,
+			Message: "Totalizer shows no fuel remaining."})
+	} else if flow.Fuel_Remaining <= globalSettings.LowFuelGallons {
+		alerts = append(alerts, Alert{Name: "LOW_FUEL", Level: ALERT_LEVEL_WARNING,
+			Message: fmt.Sprintf("Low fuel: %0.1f gal remaining.", flow.Fuel_Remaining)})
+	}
+
+	if flow.Endurance_Minutes >= 0 && flow.Endurance_Minutes <= globalSettings.LowFuelReserveMinutes {
+		alerts = append(alerts, Alert{Name: "LOW_ENDURANCE", Level: ALERT_LEVEL_CAUTION,
+			Message: fmt.Sprintf("Endurance %d min at current burn.", int(flow.Endurance_Minutes))})
+	}
+
+	if globalSettings.HighFlowGPH > 0 && flow.Flow_LastMinute_GPH > globalSettings.HighFlowGPH {
+		alerts = append(alerts, Alert{Name: "HIGH_FLOW", Level: ALERT_LEVEL_CAUTION,
+			Message: fmt.Sprintf("High fuel flow: %0.1f GPH.", flow.Flow_LastMinute_GPH)})
+	}
+
+	if globalSettings.SupplyMonitorChannel >= 0 && flow.Supply_Volts > 0 && flow.Supply_Volts < globalSettings.SupplyMonitorLowVolts {
+		alerts = append(alerts, Alert{Name: "LOW_SUPPLY", Level: ALERT_LEVEL_WARNING,
+			Message: fmt.Sprintf("Supply voltage low: %0.2fV.", flow.Supply_Volts)})
+	}
+
+	return alerts
+}
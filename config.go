@@ -0,0 +1,217 @@
+/*
+	Copyright (c) 2016 Christopher Young
+	Distributable under the terms of The "BSD New"" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	config.go: Settings file handling.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+)
+
+const (
+	CONFIG_FILE = "/etc/flowfast.conf"
+)
+
+type settings struct {
+	KFactor               float64 // Flow transducer pulses per gallon.
+	FuelCapacity          float64 // units=gallons. Usable fuel with full tanks.
+	LowFuelGallons        float64 // units=gallons. Low fuel alert threshold.
+	LowFuelReserveMinutes float64 // Low endurance alert threshold.
+	HighFlowGPH           float64 // units=GPH. High flow alert threshold. 0 = disabled.
+	SessionIdleMinutes    int     // No flow for this long ends a session.
+	StorageBackend        string  // "sqlite", "flatfile" or "memory".
+	StoragePath           string  // Database or log file for the backend.
+	DBCommitSeconds       int     // How often batched samples are written to storage.
+	JournalFile           string  // Write-ahead journal for samples not yet in storage.
+	RawRetentionDays      int     // Per-second rows older than this are pruned (sqlite: once rolled up, the rollups are kept). 0 = keep forever.
+
+	InputSource        string // "ads1115", "ads1015", "mcp3008" or "pcf8583".
+	InputReinitErrors  int    // Consecutive read errors before the input is closed and set up again.
+	InputAbsentSeconds int    // No pulses for this long: sensor absent. Only for installs powered with the engine running. 0 = off.
+
+	// Filter on the ADC input ahead of edge detection: "none", "average", "median" or "lowpass".
+	InputFilter         string
+	InputFilterWindow   int     // Samples, for "average" and "median".
+	InputFilterCutoffHz float64 // For "lowpass".
+
+	ADSAddress   int // ADS1115/ADS1015 I2C address, 0x48-0x4B (72-75).
+	ADSReadyGPIO int // GPIO wired to ALERT/RDY (with a pull-up). -1 = timed polling.
+	// units=mV. ADS1115 full scale range: 6144, 4096, 2048, 1024, 512 or 256.
+	ADSFullScaleMillivolts int
+
+	MCP3008SPIChannel     int // Chip select, 0 or 1.
+	MCP3008Input          int // 0-7.
+	MCP3008VrefMillivolts float64
+	PCF8583Address        int // 0x50 or 0x51 (80, 81).
+
+	// Supply voltage monitor. Disabled if SupplyMonitorChannel is -1.
+	SupplyMonitorChannel    int     // Spare ADS1115 input (2 or 3) wired to the supply through a divider.
+	SupplyMonitorScale      float64 // Divider ratio, supply volts per input volt.
+	SupplyMonitorLowVolts   float64 // Flush storage below this.
+	SupplyMonitorIntervalMs int
+
+	// MQTT publisher. Disabled if MQTTBroker is empty.
+	MQTTBroker        string // e.g. "tcp://hangar.local:1883" or "ssl://hangar.local:8883".
+	MQTTClientID      string
+	MQTTUsername      string
+	MQTTPassword      string
+	MQTTTopicPrefix   string // Topics are <prefix>/stats, <prefix>/alert, <prefix>/session, <prefix>/status.
+	MQTTQoS           byte
+	MQTTRetain        bool
+	MQTTStatsInterval int // units=seconds.
+	MQTTBufferLen     int // Alert and session messages held while offline.
+	MQTTTLS           bool
+	MQTTTLSInsecure   bool   // Skip broker certificate verification.
+	MQTTCACert        string // PEM file.
+	MQTTClientCert    string // PEM file.
+	MQTTClientKey     string // PEM file.
+
+	// InfluxDB export. Disabled unless InfluxURL or InfluxUDPAddr is set.
+	InfluxURL             string // e.g. "http://tsdb.local:8086/write?db=flowfast".
+	InfluxToken           string // Sent as "Authorization: Token ..." if set.
+	InfluxUDPAddr         string // e.g. "tsdb.local:8089". Used if InfluxURL is empty.
+	InfluxMeasurement     string
+	InfluxTags            map[string]string // e.g. {"aircraft": "N12345"}.
+	InfluxBatchSize       int               // units=lines.
+	InfluxFlushSeconds    int
+	InfluxBacklogFile     string
+	InfluxBacklogMaxBytes int64
+}
+
+var globalSettings settings
+
+func defaultSettings() {
+	globalSettings.KFactor = DEFAULT_K_FACTOR
+	globalSettings.FuelCapacity = 24.0
+	globalSettings.LowFuelGallons = 4.0
+	globalSettings.LowFuelReserveMinutes = 45.0
+	globalSettings.HighFlowGPH = 0.0
+	globalSettings.SessionIdleMinutes = 5
+	globalSettings.StorageBackend = "sqlite"
+	globalSettings.StoragePath = SQLITE_DB_FILE
+	if _, ok := storageBackends["sqlite"]; !ok {
+		// Built without cgo.
+		globalSettings.StorageBackend = "flatfile"
+		globalSettings.StoragePath = FLATFILE_DEFAULT_PATH
+	}
+	globalSettings.DBCommitSeconds = 15
+	globalSettings.JournalFile = "./flowfast.journal"
+	globalSettings.RawRetentionDays = 30
+
+	globalSettings.InputSource = "ads1115"
+	globalSettings.InputReinitErrors = 20
+	globalSettings.InputFilter = FILTER_NONE
+	globalSettings.InputFilterWindow = 5
+	globalSettings.InputFilterCutoffHz = 100
+	globalSettings.ADSAddress = ADS_ADDR_MIN
+	globalSettings.ADSReadyGPIO = ADS_READY_GPIO_OFF
+	globalSettings.ADSFullScaleMillivolts = 6144
+	globalSettings.MCP3008VrefMillivolts = 5000
+	globalSettings.PCF8583Address = PCF8583_ADDR_MIN
+
+	globalSettings.SupplyMonitorChannel = -1
+	globalSettings.SupplyMonitorScale = 1.0
+	globalSettings.SupplyMonitorLowVolts = 4.75
+	globalSettings.SupplyMonitorIntervalMs = 100
+
+	globalSettings.MQTTClientID = "flowfast"
+	globalSettings.MQTTTopicPrefix = "flowfast"
+	globalSettings.MQTTQoS = 1
+	globalSettings.MQTTRetain = true
+	globalSettings.MQTTStatsInterval = 1
+	globalSettings.MQTTBufferLen = 1000
+
+	globalSettings.InfluxMeasurement = "fuel_flow"
+	globalSettings.InfluxBatchSize = 60
+	globalSettings.InfluxFlushSeconds = 10
+	globalSettings.InfluxBacklogFile = "./influx_backlog.txt"
+	globalSettings.InfluxBacklogMaxBytes = 64 * 1024 * 1024
+}
+
+// Read settings from CONFIG_FILE. Missing file or fields keep the defaults.
+func readSettings() {
+	defaultSettings()
+
+	fd, err := os.Open(CONFIG_FILE)
+	if err != nil {
+		logger.Debugf("can't read '%s', using defaults: %s\n", CONFIG_FILE, err.Error())
+		return
+	}
+	defer fd.Close()
+
+	buf, err := ioutil.ReadAll(fd)
+	if err != nil {
+		logger.Errorf("can't read '%s': %s\n", CONFIG_FILE, err.Error())
+		return
+	}
+
+	newSettings := globalSettings
+	if err := json.Unmarshal(buf, &newSettings); err != nil {
+		logger.Errorf("can't parse '%s': %s\n", CONFIG_FILE, err.Error())
+		return
+	}
+	if newSettings.KFactor <= 0 {
+		logger.Errorf("invalid KFactor %f, using %f.\n", newSettings.KFactor, DEFAULT_K_FACTOR)
+		newSettings.KFactor = DEFAULT_K_FACTOR
+	}
+	if newSettings.ADSAddress < ADS_ADDR_MIN || newSettings.ADSAddress > ADS_ADDR_MAX {
+		logger.Errorf("invalid ADSAddress 0x%02x, using 0x%02x.\n", newSettings.ADSAddress, ADS_ADDR_MIN)
+		newSettings.ADSAddress = ADS_ADDR_MIN
+	}
+	if _, ok := adsGainFor(newSettings.ADSFullScaleMillivolts); !ok {
+		logger.Errorf("invalid ADSFullScaleMillivolts %d, using 6144.\n", newSettings.ADSFullScaleMillivolts)
+		newSettings.ADSFullScaleMillivolts = 6144
+	}
+	if newSettings.InputReinitErrors < 1 {
+		newSettings.InputReinitErrors = 1
+	}
+	if _, err := newSampleFilter(newSettings.InputFilter, newSettings.InputFilterWindow, newSettings.InputFilterCutoffHz); err != nil {
+		logger.Errorf("InputFilter: %s, using 'none'.\n", err.Error())
+		newSettings.InputFilter = FILTER_NONE
+	}
+	if newSettings.MCP3008Input < 0 || newSettings.MCP3008Input >= MCP3008_CHANNELS {
+		logger.Errorf("invalid MCP3008Input %d, using 0.\n", newSettings.MCP3008Input)
+		newSettings.MCP3008Input = 0
+	}
+	if newSettings.SupplyMonitorChannel != -1 && newSettings.SupplyMonitorChannel != 2 && newSettings.SupplyMonitorChannel != 3 {
+		// A0/A1 are the flow input.
+		logger.Errorf("invalid SupplyMonitorChannel %d, supply monitor disabled.\n", newSettings.SupplyMonitorChannel)
+		newSettings.SupplyMonitorChannel = -1
+	}
+	if newSettings.SupplyMonitorIntervalMs <= 0 {
+		newSettings.SupplyMonitorIntervalMs = 100
+	}
+	if newSettings.SessionIdleMinutes < 1 {
+		logger.Errorf("invalid SessionIdleMinutes %d, using 1.\n", newSettings.SessionIdleMinutes)
+		newSettings.SessionIdleMinutes = 1
+	}
+	if newSettings.DBCommitSeconds < 1 {
+		logger.Errorf("invalid DBCommitSeconds %d, using 1.\n", newSettings.DBCommitSeconds)
+		newSettings.DBCommitSeconds = 1
+	}
+	if newSettings.InfluxFlushSeconds < 1 {
+		logger.Errorf("invalid InfluxFlushSeconds %d, using 1.\n", newSettings.InfluxFlushSeconds)
+		newSettings.InfluxFlushSeconds = 1
+	}
+	if newSettings.MQTTBufferLen < 0 {
+		logger.Errorf("invalid MQTTBufferLen %d, using 1000.\n", newSettings.MQTTBufferLen)
+		newSettings.MQTTBufferLen = 1000
+	}
+	if newSettings.MQTTQoS > 2 {
+		logger.Errorf("invalid MQTTQoS %d, using 1.\n", newSettings.MQTTQoS)
+		newSettings.MQTTQoS = 1
+	}
+	if newSettings.MQTTStatsInterval < 1 {
+		logger.Errorf("invalid MQTTStatsInterval %d, using 1.\n", newSettings.MQTTStatsInterval)
+		newSettings.MQTTStatsInterval = 1
+	}
+	globalSettings = newSettings
+	logger.Debugf("read settings from '%s'.\n", CONFIG_FILE)
+}
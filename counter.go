@@ -0,0 +1,76 @@
+/*
+	Copyright (c) 2016 Christopher Young
+	Distributable under the terms of The "BSD New"" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	counter.go: Pulse counting core. Counted by the input goroutine with atomics only, read by
+		statsCalculator(), which publishes each evaluation as an immutable FlowStats snapshot.
+*/
+
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+type pulseCounter struct {
+	total  uint64 // Since start.
+	second *rateCounter
+	minute *rateCounter
+	hour   *rateCounter
+}
+
+// Counts as of one evaluation time.
+type pulseCounts struct {
+	total      uint64
+	lastSecond int64
+	lastMinute int64
+	lastHour   int64
+}
+
+func newPulseCounter() *pulseCounter {
+	return &pulseCounter{
+		second: newRateCounter(1*time.Second, 100),
+		minute: newRateCounter(1*time.Minute, 60),
+		hour:   newRateCounter(1*time.Hour, 360),
+	}
+}
+
+var pulses = newPulseCounter()
+
+// n pulses counted at sample time t.
+func (c *pulseCounter) add(n uint64, t time.Time) {
+	atomic.AddUint64(&c.total, n)
+	c.second.Incr(t, int64(n))
+	c.minute.Incr(t, int64(n))
+	c.hour.Incr(t, int64(n))
+}
+
+func (c *pulseCounter) read(now time.Time) pulseCounts {
+	return pulseCounts{
+		total:      atomic.LoadUint64(&c.total),
+		lastSecond: c.second.Rate(now),
+		lastMinute: c.minute.Rate(now),
+		lastHour:   c.hour.Rate(now),
+	}
+}
+
+// Latest FlowStats from statsCalculator(). Never modified once stored.
+var flowSnapshot atomic.Value // *FlowStats
+
+// Publish the current stats. Caller holds flow.mu.
+func publishStats() {
+	s := flow
+	s.mu = nil
+	flowSnapshot.Store(&s)
+}
+
+// The latest published stats. Read only.
+func currentStats() *FlowStats {
+	if s, ok := flowSnapshot.Load().(*FlowStats); ok {
+		return s
+	}
+	return &FlowStats{}
+}
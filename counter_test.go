@@ -0,0 +1,83 @@
+/*
+	Copyright (c) 2016 Christopher Young
+	Distributable under the terms of The "BSD New"" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	counter_test.go: Pulse counter under concurrent counting and reading.
+		go test -race -run - -bench PulseCounter
+*/
+
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Pulses at 10 kHz of sample time, counted from every parallel goroutine, with a reader
+// evaluating the counts concurrently like statsCalculator().
+func BenchmarkPulseCounter(b *testing.B) {
+	const interval = time.Second / 10000
+	c := newPulseCounter()
+	t0 := time.Now()
+	var n int64
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	reads := 0
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			c.read(t0.Add(time.Duration(atomic.LoadInt64(&n)) * interval))
+			reads++
+		}
+	}()
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			i := atomic.AddInt64(&n, 1)
+			c.add(1, t0.Add(time.Duration(i)*interval))
+		}
+	})
+	b.StopTimer()
+	close(done)
+	wg.Wait()
+
+	counts := c.read(t0.Add(time.Duration(n) * interval))
+	if counts.total != uint64(b.N) {
+		b.Fatalf("counted %d of %d pulses", counts.total, b.N)
+	}
+	// Pulses land out of order across goroutines, but all within the hour window.
+	if n < 3600*10000 && counts.lastHour != int64(b.N) {
+		b.Errorf("last hour %d of %d pulses", counts.lastHour, b.N)
+	}
+	b.ReportMetric(float64(reads), "reads")
+}
+
+func TestPulseCounterWindows(t *testing.T) {
+	c := newPulseCounter()
+	t0 := time.Now()
+	for i := 0; i < 120; i++ {
+		c.add(2, t0.Add(time.Duration(i)*time.Second))
+	}
+	counts := c.read(t0.Add(119 * time.Second))
+	if counts.total != 240 || counts.lastHour != 240 {
+		t.Errorf("total %d, last hour %d, want 240", counts.total, counts.lastHour)
+	}
+	if counts.lastSecond != 2 {
+		t.Errorf("last second %d, want 2", counts.lastSecond)
+	}
+	if counts.lastMinute < 118 || counts.lastMinute > 122 {
+		t.Errorf("last minute %d, want about 120", counts.lastMinute)
+	}
+}
@@ -0,0 +1,174 @@
+/*
+	Copyright (c) 2016 Christopher Young
+	Distributable under the terms of The "BSD New"" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	events.go: Event hub and Server-Sent Events (text/event-stream) endpoint.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	EVENT_TYPE_STATS = "stats"
+	EVENT_TYPE_ALERT = "alert"
+
+	EVENT_HISTORY_LEN   = 256 // Retained events available for Last-Event-ID resume.
+	EVENT_SUBSCRIBER_Q  = 64
+	SSE_KEEPALIVE_DELAY = 15 * time.Second
+)
+
+type streamEvent struct {
+	ID   uint64
+	Type string
+	Data []byte // JSON.
+}
+
+type eventHub struct {
+	nextID      uint64
+	history     []streamEvent // Retained events, oldest first.
+	subscribers map[chan streamEvent]bool
+	mu          *sync.Mutex
+}
+
+// IDs carry on from the previous run's (clock permitting), so a client resuming across a restart
+// isn't handed IDs it has already seen.
+var events = eventHub{
+	nextID:      uint64(time.Now().UnixNano()),
+	subscribers: make(map[chan streamEvent]bool),
+	mu:          &sync.Mutex{},
+}
+
+// Send an event to all subscribers. If retain is set, the event is kept for clients resuming
+// with Last-Event-ID. Stats snapshots are not retained, a resuming client gets the next one anyway.
+// A subscriber too slow to take a retained event is disconnected (its channel closed) and resumes
+// from the history; stats are just dropped for it.
+func (h *eventHub) publish(typ string, v interface{}, retain bool) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		logger.Errorf("json.Marshal(): %s\n", err.Error())
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	e := streamEvent{ID: h.nextID, Type: typ, Data: data}
+	h.nextID++
+
+	if retain {
+		h.history = append(h.history, e)
+		if len(h.history) > EVENT_HISTORY_LEN {
+			h.history = h.history[len(h.history)-EVENT_HISTORY_LEN:]
+		}
+	}
+
+	for ch := range h.subscribers {
+		select {
+		case ch <- e:
+		default:
+			if retain {
+				delete(h.subscribers, ch)
+				close(ch)
+			}
+		}
+	}
+}
+
+// Register a new subscriber. Returns the channel and any retained events newer than lastID. The
+// channel is closed if the subscriber falls behind, subscribe again with the last ID taken.
+func (h *eventHub) subscribe(lastID uint64) (chan streamEvent, []streamEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	ch := make(chan streamEvent, EVENT_SUBSCRIBER_Q)
+	h.subscribers[ch] = true
+
+	backlog := make([]streamEvent, 0)
+	if lastID > 0 {
+		if lastID >= h.nextID {
+			lastID = 0 // From a run with a later clock, all of the history is new.
+		}
+		for _, e := range h.history {
+			if e.ID > lastID {
+				backlog = append(backlog, e)
+			}
+		}
+	}
+	return ch, backlog
+}
+
+// Safe after publish() has dropped the subscriber.
+func (h *eventHub) unsubscribe(ch chan streamEvent) {
+	h.mu.Lock()
+	delete(h.subscribers, ch)
+	h.mu.Unlock()
+}
+
+func writeSSE(w http.ResponseWriter, e streamEvent) error {
+	_, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, e.Data)
+	return err
+}
+
+// GET /events. Streams stats snapshots and alert events. Resumes from the
+// Last-Event-ID header (or "lastEventId" query parameter) after a reconnect.
+func handleEvents(w http.ResponseWriter, req *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	lastIDStr := req.Header.Get("Last-Event-ID")
+	if len(lastIDStr) == 0 {
+		lastIDStr = req.URL.Query().Get("lastEventId")
+	}
+	lastID, _ := strconv.ParseUint(lastIDStr, 10, 64)
+
+	ch, backlog := events.subscribe(lastID)
+	defer events.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	fmt.Fprintf(w, "retry: 2000\n\n")
+
+	for _, e := range backlog {
+		if writeSSE(w, e) != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	keepalive := time.NewTicker(SSE_KEEPALIVE_DELAY)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case e, ok := <-ch:
+			if !ok {
+				return // Fell behind. The client reconnects with Last-Event-ID.
+			}
+			if writeSSE(w, e) != nil {
+				return
+			}
+		case <-keepalive.C:
+			if _, err := fmt.Fprintf(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case <-req.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,80 @@
+/*
+	Copyright (c) 2016 Christopher Young
+	Distributable under the terms of The "BSD New"" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	events_test.go: Event hub with slow subscribers and resumes across restarts.
+*/
+
+package main
+
+import (
+	"sync"
+	"testing"
+)
+
+func newTestEventHub(nextID uint64) *eventHub {
+	return &eventHub{nextID: nextID, subscribers: make(map[chan streamEvent]bool), mu: &sync.Mutex{}}
+}
+
+func TestEventHubSlowSubscriber(t *testing.T) {
+	h := newTestEventHub(1000)
+	ch, _ := h.subscribe(0)
+
+	// Stats for a full queue are dropped, the subscriber stays.
+	for i := 0; i < EVENT_SUBSCRIBER_Q+10; i++ {
+		h.publish(EVENT_TYPE_STATS, i, false)
+	}
+	if len(ch) != EVENT_SUBSCRIBER_Q || !h.subscribers[ch] {
+		t.Fatalf("after a stats overflow: %d queued, subscribed %v", len(ch), h.subscribers[ch])
+	}
+
+	// A retained event that doesn't fit disconnects it instead of being lost.
+	h.publish(EVENT_TYPE_ALERT, "low fuel", true)
+	if h.subscribers[ch] {
+		t.Fatal("slow subscriber still registered")
+	}
+	var last uint64
+	n := 0
+	for e := range ch {
+		last = e.ID
+		n++
+	}
+	if n != EVENT_SUBSCRIBER_Q {
+		t.Errorf("%d events before the close, want %d", n, EVENT_SUBSCRIBER_Q)
+	}
+	h.unsubscribe(ch) // Already gone, no double close.
+
+	// Resuming from the last event taken hands over the alert.
+	h.publish(EVENT_TYPE_SESSION, "session", true)
+	ch, backlog := h.subscribe(last)
+	defer h.unsubscribe(ch)
+	if len(backlog) != 2 || backlog[0].Type != EVENT_TYPE_ALERT || backlog[1].Type != EVENT_TYPE_SESSION {
+		t.Errorf("resume backlog %+v", backlog)
+	}
+}
+
+func TestEventHubResumeAcrossRestart(t *testing.T) {
+	h := newTestEventHub(5000)
+	h.publish(EVENT_TYPE_ALERT, "a", true)
+	h.publish(EVENT_TYPE_ALERT, "b", true)
+
+	// An ID from this run: only newer events.
+	_, backlog := h.subscribe(5000)
+	if len(backlog) != 1 || backlog[0].ID != 5001 {
+		t.Errorf("resume from 5000: %+v", backlog)
+	}
+	// An ID from a run whose clock was ahead: everything retained.
+	_, backlog = h.subscribe(90000)
+	if len(backlog) != 2 {
+		t.Errorf("resume from a later run: %d events, want 2", len(backlog))
+	}
+	// A fresh client: nothing.
+	if _, backlog = h.subscribe(0); len(backlog) != 0 {
+		t.Errorf("new subscriber got %d events", len(backlog))
+	}
+	if events.nextID <= 1 {
+		t.Errorf("event IDs start at %d", events.nextID)
+	}
+}
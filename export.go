@@ -0,0 +1,274 @@
+/*
+	Copyright (c) 2016 Christopher Young
+	Distributable under the terms of The "BSD New"" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	export.go: CSV / JSON Lines / logbook summary export of the fuel log.
+		Available as "flowfast export ..." and on /export.
+*/
+
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	EXPORT_FORMAT_CSV     = "csv"
+	EXPORT_FORMAT_JSONL   = "jsonl"
+	EXPORT_FORMAT_SUMMARY = "summary" // Per-session logbook table. Implies sessions.
+)
+
+type exportRequest struct {
+	from     time.Time
+	to       time.Time
+	format   string
+	sessions bool // Per-session summaries instead of per-second samples.
+}
+
+type exportSample struct {
+	Start   time.Time
+	End     time.Time
+	Pulses  int64
+	KFactor float64
+	Gallons float64
+	GPH     float64
+}
+
+// Accepts RFC3339, "2006-01-02" (local time) or unix seconds.
+func parseExportTime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		return t, nil
+	}
+	if secs, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(secs, 0), nil
+	}
+	return time.Time{}, fmt.Errorf("can't parse time '%s'", s)
+}
+
+// from defaults to the epoch, not the zero time: backends query in unix nanoseconds, which the
+// zero time is far outside of. to defaults to now.
+func newExportRequest(from, to, format string, sessions bool) (exportRequest, error) {
+	r := exportRequest{format: format, sessions: sessions, from: time.Unix(0, 0), to: time.Now()}
+	var err error
+	if len(from) > 0 {
+		if r.from, err = parseExportTime(from); err != nil {
+			return r, err
+		}
+	}
+	if len(to) > 0 {
+		if r.to, err = parseExportTime(to); err != nil {
+			return r, err
+		}
+	}
+	switch r.format {
+	case EXPORT_FORMAT_CSV, EXPORT_FORMAT_JSONL:
+	case EXPORT_FORMAT_SUMMARY:
+		r.sessions = true
+	default:
+		return r, fmt.Errorf("unknown format '%s'", r.format)
+	}
+	return r, nil
+}
+
+func formatDuration(d time.Duration) string {
+	m := int(d.Minutes() + 0.5)
+	return fmt.Sprintf("%d:%02d", m/60, m%60)
+}
+
+func exportSamples(st storage, w io.Writer, r exportRequest) error {
+	cw := csv.NewWriter(w)
+	enc := json.NewEncoder(w)
+	if r.format == EXPORT_FORMAT_CSV {
+		cw.Write([]string{"start", "end", "pulses", "k_factor", "gallons", "gph"})
+	}
+
+	err := st.QuerySamples(r.from, r.to, func(f fuel_log) error {
+		s := exportSample{
+			Start:   f.log_date_start,
+			End:     f.log_date_end,
+			Pulses:  int64(f.pulses),
+			KFactor: f.k_factor,
+			Gallons: f.flow,
+		}
+		if secs := s.End.Sub(s.Start).Seconds(); secs > 0 {
+			s.GPH = s.Gallons / secs * float64(3600.0)
+		}
+
+		if r.format == EXPORT_FORMAT_CSV {
+			return cw.Write([]string{
+				s.Start.Format(time.RFC3339Nano),
+				s.End.Format(time.RFC3339Nano),
+				strconv.FormatInt(s.Pulses, 10),
+				strconv.FormatFloat(s.KFactor, 'f', -1, 64),
+				strconv.FormatFloat(s.Gallons, 'f', 6, 64),
+				strconv.FormatFloat(s.GPH, 'f', 2, 64),
+			})
+		}
+		return enc.Encode(s)
+	})
+	if err != nil {
+		return err
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func exportSessions(st storage, w io.Writer, r exportRequest) error {
+	cw := csv.NewWriter(w)
+	enc := json.NewEncoder(w)
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	switch r.format {
+	case EXPORT_FORMAT_CSV:
+		cw.Write([]string{"start", "end", "duration", "pulses", "gallons", "avg_gph", "max_gph"})
+	case EXPORT_FORMAT_SUMMARY:
+		fmt.Fprintf(tw, "Date\tStart\tEnd\tDuration\tFuel (gal)\tAvg GPH\tMax GPH\n")
+	}
+
+	var totalTime time.Duration
+	var totalFuel float64
+	err := st.QuerySessions(r.from, r.to, func(s sessionSummary) error {
+		dur := s.End.Sub(s.Start)
+		totalTime += dur
+		totalFuel += s.Fuel_Used
+
+		switch r.format {
+		case EXPORT_FORMAT_CSV:
+			return cw.Write([]string{
+				s.Start.Format(time.RFC3339),
+				s.End.Format(time.RFC3339),
+				formatDuration(dur),
+				strconv.FormatUint(s.Pulses, 10),
+				strconv.FormatFloat(s.Fuel_Used, 'f', 2, 64),
+				strconv.FormatFloat(s.Avg_GPH, 'f', 1, 64),
+				strconv.FormatFloat(s.Max_GPH, 'f', 1, 64),
+			})
+		case EXPORT_FORMAT_JSONL:
+			return enc.Encode(s)
+		}
+		_, err := fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%0.1f\t%0.1f\t%0.1f\n", s.Start.Format("2006-01-02"), s.Start.Format("15:04"), s.End.Format("15:04"),
+			formatDuration(dur), s.Fuel_Used, s.Avg_GPH, s.Max_GPH)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if r.format == EXPORT_FORMAT_SUMMARY {
+		avg := float64(0)
+		if totalTime > 0 {
+			avg = totalFuel / totalTime.Hours()
+		}
+		fmt.Fprintf(tw, "Total\t\t\t%s\t%0.1f\t%0.1f\t\n", formatDuration(totalTime), totalFuel, avg)
+		return tw.Flush()
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func exportData(st storage, w io.Writer, r exportRequest) error {
+	if r.sessions {
+		return exportSessions(st, w, r)
+	}
+	return exportSamples(st, w, r)
+}
+
+// GET /export?from=...&to=...&format=csv|jsonl|summary[&sessions=1].
+func handleExport(w http.ResponseWriter, req *http.Request) {
+	q := req.URL.Query()
+	format := q.Get("format")
+	if len(format) == 0 {
+		format = EXPORT_FORMAT_CSV
+	}
+	r, err := newExportRequest(q.Get("from"), q.Get("to"), format, len(q.Get("sessions")) > 0)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	name := "flowfast_samples"
+	if r.sessions {
+		name = "flowfast_sessions"
+	}
+	switch r.format {
+	case EXPORT_FORMAT_CSV:
+		w.Header().Set("Content-Type", "text/csv")
+		name += ".csv"
+	case EXPORT_FORMAT_JSONL:
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		name += ".jsonl"
+	case EXPORT_FORMAT_SUMMARY:
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		name += ".txt"
+	}
+
+	ok, err := withFuelStore(func(st storage) error {
+		w.Header().Set("Content-Disposition", "attachment; filename=\""+name+"\"")
+		return exportData(st, w, r)
+	})
+	if !ok {
+		http.Error(w, "database not open", http.StatusServiceUnavailable)
+	} else if err != nil {
+		// Headers are gone by now, all we can do is log it.
+		logger.Errorf("exportData(): %s\n", err.Error())
+	}
+}
+
+// "flowfast export [flags]". Reads the storage directly, the daemon doesn't need to be running.
+func exportCommand(args []string) int {
+	readSettings()
+
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	backend := fs.String("storage", globalSettings.StorageBackend, "storage backend: sqlite or flatfile")
+	dbFile := fs.String("db", globalSettings.StoragePath, "database or log file")
+	from := fs.String("from", "", "start time: RFC3339, YYYY-MM-DD or unix seconds (default: beginning)")
+	to := fs.String("to", "", "end time, exclusive (default: now)")
+	format := fs.String("format", EXPORT_FORMAT_CSV, "csv, jsonl or summary")
+	sessions := fs.Bool("sessions", false, "export per-session summaries instead of per-second samples")
+	out := fs.String("o", "", "output file (default: stdout)")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	r, err := newExportRequest(*from, *to, *format, *sessions)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "export: %s\n", err.Error())
+		return 2
+	}
+
+	st, err := openStorageReadOnly(*backend, *dbFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "export: %s\n", err.Error())
+		return 1
+	}
+	defer st.Close()
+
+	w := io.Writer(os.Stdout)
+	if len(*out) > 0 {
+		fp, err := os.Create(*out)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "export: %s\n", err.Error())
+			return 1
+		}
+		defer fp.Close()
+		w = fp
+	}
+
+	if err := exportData(st, w, r); err != nil {
+		fmt.Fprintf(os.Stderr, "export: %s\n", err.Error())
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,205 @@
+/*
+	Copyright (c) 2016 Christopher Young
+	Distributable under the terms of The "BSD New"" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	export_test.go: Export requests and the CSV, JSON Lines and summary output, against the memory
+		backend.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var exportT0 = time.Unix(1700000000, 0).UTC()
+
+// Three one-second samples and two sessions.
+func newExportFixture() *memoryStorage {
+	st := &memoryStorage{mu: &sync.Mutex{}}
+	samples := make([]fuel_log, 3)
+	for i := range samples {
+		start := exportT0.Add(time.Duration(i) * time.Second)
+		samples[i] = fuel_log{log_date_start: start, log_date_end: start.Add(time.Second), pulses: 68, k_factor: 68000, flow: 0.001}
+	}
+	st.AppendSamples(samples)
+	st.AppendSession(sessionSummary{Start: exportT0, End: exportT0.Add(90 * time.Minute), Fuel_Used: 12.5, Avg_GPH: 8.3, Max_GPH: 10.1, Pulses: 850000})
+	st.AppendSession(sessionSummary{Start: exportT0.Add(3 * time.Hour), End: exportT0.Add(3*time.Hour + 30*time.Minute), Fuel_Used: 4, Avg_GPH: 8, Max_GPH: 9, Pulses: 272000})
+	return st
+}
+
+func runExport(t *testing.T, st storage, from, to, format string, sessions bool) (string, error) {
+	t.Helper()
+	r, err := newExportRequest(from, to, format, sessions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	err = exportData(st, &buf, r)
+	return buf.String(), err
+}
+
+// Memory storage that fails a query after a number of rows.
+type cutShortStorage struct {
+	*memoryStorage
+	after int
+}
+
+var errCutShort = errors.New("disk read error")
+
+func (s cutShortStorage) QuerySamples(from, to time.Time, fn func(fuel_log) error) error {
+	n := 0
+	return s.memoryStorage.QuerySamples(from, to, func(f fuel_log) error {
+		if n++; n > s.after {
+			return errCutShort
+		}
+		return fn(f)
+	})
+}
+
+func (s cutShortStorage) QuerySessions(from, to time.Time, fn func(sessionSummary) error) error {
+	n := 0
+	return s.memoryStorage.QuerySessions(from, to, func(sum sessionSummary) error {
+		if n++; n > s.after {
+			return errCutShort
+		}
+		return fn(sum)
+	})
+}
+
+func TestNewExportRequest(t *testing.T) {
+	r, err := newExportRequest("", "", EXPORT_FORMAT_CSV, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.from.Equal(time.Unix(0, 0)) || r.from.UnixNano() != 0 {
+		t.Errorf("default from %v", r.from)
+	}
+	if time.Since(r.to) > time.Minute {
+		t.Errorf("default to %v", r.to)
+	}
+
+	r, err = newExportRequest("2023-11-14T22:13:20Z", "1700003600", EXPORT_FORMAT_SUMMARY, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.from.Equal(exportT0) || !r.to.Equal(exportT0.Add(time.Hour)) || !r.sessions {
+		t.Errorf("request %+v", r)
+	}
+
+	if _, err := newExportRequest("yesterday", "", EXPORT_FORMAT_CSV, false); err == nil {
+		t.Error("bad from accepted")
+	}
+	if _, err := newExportRequest("", "", "xml", false); err == nil {
+		t.Error("unknown format accepted")
+	}
+}
+
+func TestExportSamples(t *testing.T) {
+	st := newExportFixture()
+
+	out, err := runExport(t, st, "", "", EXPORT_FORMAT_CSV, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "start,end,pulses,k_factor,gallons,gph\n" +
+		"2023-11-14T22:13:20Z,2023-11-14T22:13:21Z,68,68000,0.001000,3.60\n" +
+		"2023-11-14T22:13:21Z,2023-11-14T22:13:22Z,68,68000,0.001000,3.60\n" +
+		"2023-11-14T22:13:22Z,2023-11-14T22:13:23Z,68,68000,0.001000,3.60\n"
+	if out != want {
+		t.Errorf("csv:\n%s\nwant:\n%s", out, want)
+	}
+
+	out, err = runExport(t, st, "1700000001", "1700000002", EXPORT_FORMAT_JSONL, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("jsonl: %d lines, want 1:\n%s", len(lines), out)
+	}
+	var s exportSample
+	if err := json.Unmarshal([]byte(lines[0]), &s); err != nil {
+		t.Fatal(err)
+	}
+	if !s.Start.Equal(exportT0.Add(time.Second)) || s.Pulses != 68 || s.GPH != 3.6 {
+		t.Errorf("jsonl sample %+v", s)
+	}
+
+	// Nothing in range: the CSV header only, no JSON lines.
+	if out, err := runExport(t, st, "1600000000", "1600003600", EXPORT_FORMAT_CSV, false); err != nil || out != "start,end,pulses,k_factor,gallons,gph\n" {
+		t.Errorf("empty csv: %q, %v", out, err)
+	}
+	if out, err := runExport(t, st, "1600000000", "1600003600", EXPORT_FORMAT_JSONL, false); err != nil || out != "" {
+		t.Errorf("empty jsonl: %q, %v", out, err)
+	}
+
+	// A failed query is reported, not passed off as a short export.
+	out, err = runExport(t, cutShortStorage{st, 1}, "", "", EXPORT_FORMAT_JSONL, false)
+	if err != errCutShort {
+		t.Errorf("cut short jsonl: %v", err)
+	}
+	if n := strings.Count(out, "\n"); n != 1 {
+		t.Errorf("cut short jsonl: %d lines before the error, want 1", n)
+	}
+	if _, err := runExport(t, cutShortStorage{st, 1}, "", "", EXPORT_FORMAT_CSV, false); err != errCutShort {
+		t.Errorf("cut short csv: %v", err)
+	}
+}
+
+func TestExportSessions(t *testing.T) {
+	st := newExportFixture()
+
+	out, err := runExport(t, st, "", "", EXPORT_FORMAT_CSV, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "start,end,duration,pulses,gallons,avg_gph,max_gph\n" +
+		"2023-11-14T22:13:20Z,2023-11-14T23:43:20Z,1:30,850000,12.50,8.3,10.1\n" +
+		"2023-11-15T01:13:20Z,2023-11-15T01:43:20Z,0:30,272000,4.00,8.0,9.0\n"
+	if out != want {
+		t.Errorf("sessions csv:\n%s\nwant:\n%s", out, want)
+	}
+
+	out, err = runExport(t, st, "", "", EXPORT_FORMAT_JSONL, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sum sessionSummary
+	if err := json.Unmarshal([]byte(strings.SplitN(out, "\n", 2)[0]), &sum); err != nil || sum.Fuel_Used != 12.5 || sum.Pulses != 850000 {
+		t.Errorf("sessions jsonl: %+v, %v", sum, err)
+	}
+
+	out, err = runExport(t, st, "", "", EXPORT_FORMAT_SUMMARY, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = "Date        Start  End    Duration  Fuel (gal)  Avg GPH  Max GPH\n" +
+		"2023-11-14  22:13  23:43  1:30      12.5        8.3      10.1\n" +
+		"2023-11-15  01:13  01:43  0:30      4.0         8.0      9.0\n" +
+		"Total                     2:00      16.5        8.2      \n"
+	if out != want {
+		t.Errorf("summary:\n%s\nwant:\n%s", out, want)
+	}
+
+	// Nothing in range: the totals line reads zero.
+	out, err = runExport(t, st, "1600000000", "1600003600", EXPORT_FORMAT_SUMMARY, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "Total") || !strings.Contains(out, "0:00") || strings.Count(out, "\n") != 2 {
+		t.Errorf("empty summary:\n%s", out)
+	}
+
+	if _, err := runExport(t, cutShortStorage{st, 1}, "", "", EXPORT_FORMAT_SUMMARY, false); err != errCutShort {
+		t.Errorf("cut short summary: %v", err)
+	}
+}
@@ -0,0 +1,105 @@
+/*
+	Copyright (c) 2016 Christopher Young
+	Distributable under the terms of The "BSD New"" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	filter.go: Filters on the mV stream ahead of edge detection in processInput(), against ignition
+		noise and pump ripple. Picked by InputFilter. Checked against a recorded waveform in filter_test.go.
+*/
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+const (
+	FILTER_NONE    = "none"
+	FILTER_AVERAGE = "average" // Moving average over InputFilterWindow samples.
+	FILTER_MEDIAN  = "median"  // Moving median over InputFilterWindow samples. Drops short spikes outright.
+	FILTER_LOWPASS = "lowpass" // First order IIR low-pass at InputFilterCutoffHz.
+)
+
+type sampleFilter interface {
+	// Filtered value for the sample mv taken at t.
+	filter(t time.Time, mv float64) float64
+}
+
+func newSampleFilter(name string, window int, cutoffHz float64) (sampleFilter, error) {
+	switch name {
+	case FILTER_NONE, "":
+		return noFilter{}, nil
+	case FILTER_AVERAGE, FILTER_MEDIAN:
+		if window < 1 {
+			return nil, fmt.Errorf("invalid filter window %d", window)
+		}
+		w := &windowFilter{buf: make([]float64, 0, window)}
+		if name == FILTER_MEDIAN {
+			w.sorted = make([]float64, 0, window)
+		}
+		return w, nil
+	case FILTER_LOWPASS:
+		if cutoffHz <= 0 {
+			return nil, fmt.Errorf("invalid filter cutoff %g Hz", cutoffHz)
+		}
+		return &lowpassFilter{rc: 1 / (2 * math.Pi * cutoffHz)}, nil
+	}
+	return nil, fmt.Errorf("unknown filter '%s'", name)
+}
+
+type noFilter struct{}
+
+func (noFilter) filter(t time.Time, mv float64) float64 {
+	return mv
+}
+
+// Moving average, or median if sorted is set. Over the samples so far until the window fills.
+type windowFilter struct {
+	buf    []float64 // Ring, oldest at next once full.
+	next   int
+	sum    float64
+	sorted []float64 // Scratch for the median.
+}
+
+func (w *windowFilter) filter(t time.Time, mv float64) float64 {
+	if len(w.buf) < cap(w.buf) {
+		w.buf = append(w.buf, mv)
+	} else {
+		w.sum -= w.buf[w.next]
+		w.buf[w.next] = mv
+		w.next = (w.next + 1) % len(w.buf)
+	}
+	w.sum += mv
+
+	if w.sorted == nil {
+		return w.sum / float64(len(w.buf))
+	}
+	w.sorted = append(w.sorted[:0], w.buf...)
+	sort.Float64s(w.sorted)
+	n := len(w.sorted)
+	if n%2 == 1 {
+		return w.sorted[n/2]
+	}
+	return (w.sorted[n/2-1] + w.sorted[n/2]) / 2
+}
+
+// y += a*(x-y), a = dt/(RC+dt). dt from the sample timestamps, so uneven sampling doesn't move the cutoff.
+type lowpassFilter struct {
+	rc   float64 // units=seconds.
+	y    float64
+	last time.Time // Zero before the first sample.
+}
+
+func (f *lowpassFilter) filter(t time.Time, mv float64) float64 {
+	if f.last.IsZero() {
+		f.y = mv
+	} else if dt := t.Sub(f.last).Seconds(); dt > 0 {
+		f.y += dt / (f.rc + dt) * (mv - f.y)
+	}
+	f.last = t
+	return f.y
+}
@@ -4,7 +4,7 @@
 	that can be found in the LICENSE file, herein included
 	as part of this header.
 
-	flowfast.go: Counts inputs from ADS1115, sends over a websocket.
+	flowfast.go: Counts flow transducer pulses, sends over a websocket.
 */
 
 // A0 = -
@@ -14,26 +14,31 @@
 package main
 
 import (
-	"database/sql"
+	"context"
+	"embed"
 	"encoding/json"
-	"fmt"
-	"github.com/kidoman/embd"
 	_ "github.com/kidoman/embd/host/all"
-	_ "github.com/mattn/go-sqlite3"
 	"github.com/op/go-logging"
-	"github.com/paulbellamy/ratecounter"
 	"golang.org/x/net/websocket"
 	"math"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 )
 
 const (
-	GALLONS_PER_CLICK = 1 / 68000.0 // FT-60 K-factor: 68,000.
-	SQLITE_DB_FILE    = "./test.db"
-	LISTEN_ADDR       = ":8081"
+	DEFAULT_K_FACTOR = 68000.0 // FT-60 K-factor: 68,000 pulses per gallon.
+	SQLITE_DB_FILE   = "./test.db"
+	LISTEN_ADDR      = ":8081"
+
+	WEB_SHUTDOWN_TIMEOUT = 2 * time.Second
+	SHUTDOWN_TIMEOUT     = 15 * time.Second // Give up draining and exit non-zero after this long.
 )
 
 type FlowStats struct {
@@ -48,11 +53,18 @@ type FlowStats struct {
 	Flow_LastMinute_GPH      float64
 	Flow_MaxPerMinute_GPH    float64
 	Flow_LastHour_Actual_GPH float64
-	// Rate counters.
-	flow_total_raw   uint64
-	flow_last_second *ratecounter.RateCounter
-	flow_last_minute *ratecounter.RateCounter
-	flow_last_hour   *ratecounter.RateCounter
+	Flow_Instant_GPH         float64 // From the edge period at low flow, see period.go.
+	// units=gallons.
+	Fuel_Start     float64 // Fuel on board when last set.
+	Fuel_Remaining float64
+	// units=minutes. -1 when not burning.
+	Endurance_Minutes float64
+	Supply_Volts      float64 // 0 if not monitored.
+	Alerts            []Alert
+	Input_Health      inputHealthStatus
+	Signal_Quality    signalQualityStatus // ADC inputs only, see quality.go.
+	flow_total_raw    uint64              // Pulses counted as of EvaluatedTime.
+	fuel_start_raw    uint64              // flow_total_raw when Fuel_Start was set.
 
 	mu *sync.Mutex
 }
@@ -60,61 +72,146 @@ type FlowStats struct {
 type fuel_log struct {
 	log_date_start time.Time
 	log_date_end   time.Time
-	flow           float64
+	flow           float64 // units=gallons.
+	pulses         uint64  // Raw pulses counted in the interval.
+	k_factor       float64 // Pulses per gallon in effect for the interval.
+	fuel_remaining float64 // Totalizer at the end of the interval, units=gallons. Journal only.
 }
 
 var flow FlowStats
 
+func gallonsPerClick() float64 {
+	return 1 / globalSettings.KFactor
+}
+
 var logger = logging.MustGetLogger("flowfast")
 
 func statusWebSocket(conn *websocket.Conn) {
 	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
+
+	metrics.websocketConnected(1)
+	defer metrics.websocketConnected(-1)
 
 	for {
-		<-ticker.C
+		select {
+		case <-ticker.C:
+		case <-conn.Request().Context().Done():
+			return // Shutting down.
+		}
 
-		flow.mu.Lock()
-		updateJSON, _ := json.Marshal(&flow) //TODO.
-		flow.mu.Unlock()
+		updateJSON, _ := json.Marshal(currentStats())
 
-		conn.Write(updateJSON)
+		if _, err := conn.Write(updateJSON); err != nil {
+			return // Client went away.
+		}
 	}
 }
 
-func startWebListener() {
+// Dashboard page and its scripts, served from the binary.
+//
+//go:embed flowfast.html js
+var webFiles embed.FS
+
+// Serves until ctx is cancelled. Request contexts are derived from ctx, so long-lived handlers
+// (/events, the websocket) return when it is.
+func startWebListener(ctx context.Context) {
+	fileServer := http.FileServer(http.FS(webFiles))
+	wsServer := websocket.Server{
+		Handler: websocket.Handler(statusWebSocket)}
+
 	http.HandleFunc("/",
 		func(w http.ResponseWriter, req *http.Request) {
-			s := websocket.Server{
-				Handler: websocket.Handler(statusWebSocket)}
-			s.ServeHTTP(w, req)
+			// Websocket clients (stratux) connect on "/", browsers get the dashboard.
+			if strings.EqualFold(req.Header.Get("Upgrade"), "websocket") {
+				wsServer.ServeHTTP(w, req)
+				return
+			}
+			if req.URL.Path == "/" {
+				req.URL.Path = "/flowfast.html"
+			}
+			fileServer.ServeHTTP(w, req)
 		})
+	http.HandleFunc("/history", handleHistory)
+	http.HandleFunc("/fuel", handleFuel)
+	http.HandleFunc("/events", handleEvents)
+	http.HandleFunc("/metrics", handleMetrics)
+	http.HandleFunc("/export", handleExport)
+	http.HandleFunc("/health", handleHealth)
+
+	server := &http.Server{
+		Addr:        LISTEN_ADDR,
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+	go func() {
+		<-ctx.Done()
+		sctx, cancel := context.WithTimeout(context.Background(), WEB_SHUTDOWN_TIMEOUT)
+		defer cancel()
+		if err := server.Shutdown(sctx); err != nil {
+			server.Close()
+		}
+	}()
 
 	logger.Debugf("listening on %s.\n", LISTEN_ADDR)
-	err := http.ListenAndServe(LISTEN_ADDR, nil)
-	if err != nil {
+	err := server.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
 		logger.Errorf("can't listen on socket: %s\n", err.Error())
 		os.Exit(-1)
 	}
 }
 
-var i2cbus embd.I2CBus
+// POST /fuel with "gallons" set to the fuel now on board, or "full" to use FuelCapacity.
+func handleFuel(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+
+	gallons := globalSettings.FuelCapacity
+	if req.FormValue("full") == "" {
+		g, err := strconv.ParseFloat(req.FormValue("gallons"), 64)
+		if err != nil || g < 0 {
+			http.Error(w, "invalid gallons", http.StatusBadRequest)
+			return
+		}
+		gallons = g
+	}
+
+	flow.mu.Lock()
+	setFuelOnBoard(gallons)
+	updateFuelRemaining()
+	publishStats()
+	flow.mu.Unlock()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Fed by readInput(), which closes it on shutdown. Made here so other goroutines (metrics) can
+// read it from the start.
+var inputChan = make(chan inputSample, 1024)
 
-var inputChan chan float64
+// Closed by processInput() once inputChan has been closed and drained.
+var inputDone = make(chan struct{})
 
-// Re-calculate stats every second.
+// Re-calculate stats every second. Once the input is drained, logs the final partial interval
+// and closes logChan (and influxChan) so the writers can flush and exit.
 func statsCalculator() {
 	ticker := time.NewTicker(1 * time.Second)
-	last_update := time.Now()
-	for {
-		<-ticker.C
+	defer ticker.Stop()
+	last_update := inputClock.now()
+	last_raw := uint64(0)
+
+	update := func() {
 		flow.mu.Lock()
 
-		flow.EvaluatedTime = time.Now()
+		// Rates as of the latest sample, so samples still queued don't read as a drop in flow.
+		flow.EvaluatedTime = inputClock.now()
 
-		flow.Flow_Total = float64(flow.flow_total_raw) * GALLONS_PER_CLICK
-		flow.Flow_LastSecond = float64(flow.flow_last_second.Rate()) * GALLONS_PER_CLICK
-		flow.Flow_LastMinute = float64(flow.flow_last_minute.Rate()) * GALLONS_PER_CLICK
-		flow.Flow_LastHour_Actual_GPH = float64(flow.flow_last_hour.Rate()) * GALLONS_PER_CLICK
+		c := pulses.read(flow.EvaluatedTime)
+		flow.flow_total_raw = c.total
+		flow.Flow_Total = float64(c.total) * gallonsPerClick()
+		flow.Flow_LastSecond = float64(c.lastSecond) * gallonsPerClick()
+		flow.Flow_LastMinute = float64(c.lastMinute) * gallonsPerClick()
+		flow.Flow_LastHour_Actual_GPH = float64(c.lastHour) * gallonsPerClick()
 
 		// Calculate maximums.
 		if flow.Flow_LastMinute > flow.Flow_MaxPerMinute {
@@ -126,22 +223,73 @@ func statsCalculator() {
 		flow.Flow_LastSecond_GPH = flow.Flow_LastSecond * float64(3600.0)
 		flow.Flow_LastMinute_GPH = flow.Flow_LastMinute * float64(60.0)
 
+		// Instantaneous rate. Count based only for inputs without edge timing.
+		countRate := float64(c.lastSecond)
+		instRate := countRate
+		if periodRate, ok := flowPeriod.rate(flow.EvaluatedTime); ok {
+			instRate = blendFlowRate(periodRate, countRate)
+		}
+		flow.Flow_Instant_GPH = instRate * gallonsPerClick() * float64(3600.0)
+
+		flow.Input_Health = health.evaluate(flow.EvaluatedTime)
+		flow.Signal_Quality = quality.evaluate(flow.EvaluatedTime)
+		updateFuelRemaining()
+		prevAlerts, alerts := flow.Alerts, checkAlerts()
+		flow.Alerts = alerts
+		publishStats()
+
+		// Log the interval in sample time, like the rates.
+		t := flow.EvaluatedTime
+		totalRaw, minuteGPH := flow.flow_total_raw, flow.Flow_LastMinute_GPH
+		intervalPulses := totalRaw - last_raw
+		f := fuel_log{
+			log_date_start: last_update,
+			log_date_end:   t,
+			flow:           float64(intervalPulses) * gallonsPerClick(),
+			pulses:         intervalPulses,
+			k_factor:       globalSettings.KFactor,
+			fuel_remaining: flow.Fuel_Remaining,
+		}
+		flow.mu.Unlock()
+
+		// Subscribers and the storage queue can block, the stats handlers shouldn't wait on them.
+		publishAlertChanges(prevAlerts, alerts, t)
+		sessions.update(t, totalRaw, minuteGPH)
+		events.publish(EVENT_TYPE_STATS, currentStats(), false)
+
 		// Update SQLite database.
-		t := time.Now()
-		logChan <- fuel_log{log_date_start: last_update, log_date_end: t, flow: flow.Flow_LastSecond}
+		logChan <- f
 		last_update = t
+		last_raw = totalRaw
 
-		flow.mu.Unlock()
+		// Time-series export, if enabled. Never hold up the stats for it.
+		select {
+		case influxChan <- f:
+		default:
+		}
 	}
-}
-
-func processInput() {
-
-	inputHigh := false
 
 	for {
-		mv := <-inputChan
+		select {
+		case <-ticker.C:
+			update()
+		case <-inputDone:
+			update()
+			close(logChan)
+			if influxChan != nil {
+				close(influxChan)
+			}
+			return
+		}
+	}
+}
 
+// Filter samples from in and find the rising edges: into 5V +-1V after being within 1V of 0V.
+// fn gets every sample, unfiltered, and whether it was an edge. Returns once in is closed.
+func detectEdges(in <-chan inputSample, filt sampleFilter, fn func(s inputSample, edge bool)) {
+	inputHigh := false
+	for s := range in {
+		mv := filt.filter(s.Time, s.Millivolts)
 		countCondition := false
 
 		// 0V low.
@@ -156,109 +304,34 @@ func processInput() {
 			//		logger.Debugf("count! %f\n", mv)
 		}
 
-		if countCondition {
-			flow.flow_total_raw++
-			flow.flow_last_second.Incr(1)
-			flow.flow_last_minute.Incr(1)
-			flow.flow_last_hour.Incr(1)
-		}
+		fn(s, countCondition)
 	}
 }
 
-// Ref: https://github.com/jrowberg/i2cdevlib/blob/master/Arduino/ADS1115/ADS1115.cpp
-// Ref: https://github.com/jrowberg/i2cdevlib/blob/master/Arduino/ADS1115/ADS1115.h
+func processInput() {
+	defer close(inputDone)
 
-func writeBitsW(bus embd.I2CBus, reg byte, bit_start, val_len uint, val uint16) {
-	cur_val, err := bus.ReadWordFromReg(0x48, reg)
+	filt, err := newSampleFilter(globalSettings.InputFilter, globalSettings.InputFilterWindow, globalSettings.InputFilterCutoffHz)
 	if err != nil {
-		logger.Errorf("ReadWordFromReg(): %s\n", err.Error())
-		return
+		filt = noFilter{} // Checked by readSettings().
 	}
 
-	mask := uint16(((1 << val_len) - 1) << (bit_start - val_len + 1))
-	val = val << (bit_start - val_len + 1)
-	val &= mask
-	cur_val &= ^(mask)
-	cur_val |= val
-	bus.WriteWordToReg(0x48, reg, cur_val)
-}
-
-func readADS1115() {
-	inputChan = make(chan float64, 1024)
-
-	go processInput()
-	go statsCalculator()
-
-	i2cbus = embd.NewI2CBus(1) //TODO: error checking.
-
-	// Set up the device. ADS1115::setRate().
-	writeBitsW(i2cbus, 0x01, 7, 3, 0x07)  // 3300 samples/sec.
-	writeBitsW(i2cbus, 0x01, 8, 1, 0)     // MODE_CONTINUOUS.
-	writeBitsW(i2cbus, 0x01, 11, 3, 0x00) // +/-6.144V. 3 mV div.
-	writeBitsW(i2cbus, 0x01, 14, 3, 0x00) // setMultiplexer(MUX_P0_N1).
-
-	for {
-		v, err := i2cbus.ReadWordFromReg(0x48, 0x00)
-
-		cv := int16(v >> 4)
-		if v>>15 != 0 {
-			cv = cv - 0xFFF
+	detectEdges(inputChan, filt, func(s inputSample, edge bool) {
+		quality.sample(s.Time, s.Millivolts)
+		if edge {
+			flowPeriod.edge(s.Time)
+			countPulses(1, s.Time)
+		} else {
+			inputClock.set(s.Time)
 		}
-		mv := float64(cv) * float64(3.0) // units=mV.
-		if err != nil {
-			logger.Errorf("ReadWordFromReg(): %s\n", err.Error())
-		}
-
-		inputChan <- mv
-		time.Sleep(500 * time.Microsecond) // Oversampling.
-	}
-
-	return
+	})
 }
 
-var logChan chan fuel_log
-
-// Logs fuel data to an SQLite database.
-func dbLogger() {
-	logChan = make(chan fuel_log, 1024)
-
-	// Check if we need to create a new database.
-	createDatabase := false
-	if _, err := os.Stat(SQLITE_DB_FILE); os.IsNotExist(err) {
-		createDatabase = true
-		logger.Debugf("creating new database '%s'.\n", SQLITE_DB_FILE)
-	}
-
-	db, err := sql.Open("sqlite3", SQLITE_DB_FILE)
-	if err != nil {
-		logger.Errorf("sql.Open(): %s\n", err.Error())
-	}
-	defer db.Close()
-
-	if createDatabase {
-		createSmt := `
-			CREATE TABLE fuel_flow (id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT, log_date_start INTEGER, log_date_end INTEGER, flow REAL);
-		`
-
-		_, err = db.Exec(createSmt)
-		if err != nil {
-			logger.Errorf("%q: %s\n", err, createSmt)
-			return
-		}
-	}
-
-	for {
-		f := <-logChan
-		//FIXME: Timestamps here are a hack.
-		q := fmt.Sprintf("INSERT INTO fuel_flow(log_date_start, log_date_end, flow) values(%d, %d, %f)", f.log_date_start.Unix(), f.log_date_end.Unix(), f.flow)
-		_, err = db.Exec(q)
-		if err != nil {
-			logger.Errorf("stmt.Exec(): %s\n", err.Error())
-		}
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "export" {
+		os.Exit(exportCommand(os.Args[2:]))
 	}
-}
 
-func main() {
 	// Set up logging for stdout (colors).
 	logBackend := logging.NewLogBackend(os.Stderr, "", 0)
 	logFormat := logging.MustStringFormatter(`%{color}%{time:15:04:05.000} %{shortfunc} ▶ %{level:.4s} %{id:03x}%{color:reset} %{message}`)
@@ -275,16 +348,73 @@ func main() {
 	logFileBackendFormatter := logging.NewBackendFormatter(logFileBackend, logFormat)
 	logging.SetBackend(logBackendFormatter, logFileBackendFormatter)
 
-	// Set up rate counters and mutex.
-	flow.flow_last_second = ratecounter.NewRateCounter(1 * time.Second)
-	flow.flow_last_minute = ratecounter.NewRateCounter(1 * time.Minute)
-	flow.flow_last_hour = ratecounter.NewRateCounter(1 * time.Hour)
+	readSettings()
+
 	flow.mu = &sync.Mutex{}
 
-	go startWebListener()
-	go dbLogger()
-	go readADS1115()
+	// Replay the journal left by the last run, and pick up the totalizer where it stopped.
+	j, replay, remaining, haveTotalizer, err := openJournal(globalSettings.JournalFile)
+	if err != nil {
+		logger.Errorf("openJournal(): %s\n", err.Error())
+	}
+	journal = j
+	if haveTotalizer {
+		setFuelOnBoard(remaining)
+	} else {
+		setFuelOnBoard(globalSettings.FuelCapacity) // Assume full tanks.
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+
+	// Writers that drain their queues on shutdown.
+	var writers sync.WaitGroup
 
-	// Wait indefinitely.
-	select {}
+	go startWebListener(ctx)
+	if len(globalSettings.MQTTBroker) > 0 {
+		writers.Add(1)
+		go func() {
+			defer writers.Done()
+			mqttPublisher(ctx)
+		}()
+	}
+	if len(globalSettings.InfluxURL) > 0 || len(globalSettings.InfluxUDPAddr) > 0 {
+		influxChan = make(chan fuel_log, 1024)
+		writers.Add(1)
+		go func() {
+			defer writers.Done()
+			influxExporter()
+		}()
+	}
+	writers.Add(1)
+	go func() {
+		defer writers.Done()
+		storageLogger(replay, flow.Fuel_Remaining)
+	}()
+	go readInput(ctx)
+
+	sig := <-sigs
+	logger.Warningf("%s, shutting down.\n", sig)
+
+	// Stopping the input closes inputChan -> logChan/influxChan in turn, the writers flush and return.
+	cancel()
+	drained := make(chan struct{})
+	go func() {
+		writers.Wait()
+		close(drained)
+	}()
+
+	status := 0
+	select {
+	case <-drained:
+	case sig = <-sigs:
+		logger.Errorf("%s, exiting without waiting.\n", sig)
+		status = 1
+	case <-time.After(SHUTDOWN_TIMEOUT):
+		logger.Errorf("timed out waiting for writers to flush.\n")
+		status = 1
+	}
+	logFileFp.Close()
+	os.Exit(status)
 }
@@ -0,0 +1,157 @@
+/*
+	Copyright (c) 2016 Christopher Young
+	Distributable under the terms of The "BSD New"" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	health.go: Flow input diagnostics. Read errors, re-inits, and a stuck, saturated or absent
+		signal. Served on /health and included in the stats as Input_Health.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	HEALTH_OK        = "ok"
+	HEALTH_ERROR     = "error"     // Reads failing.
+	HEALTH_STUCK     = "stuck"     // Identical readings for INPUT_STUCK_TIME.
+	HEALTH_SATURATED = "saturated" // At the ADC's full scale for INPUT_SATURATED_TIME.
+	HEALTH_ABSENT    = "absent"    // No pulses for InputAbsentSeconds.
+
+	INPUT_STUCK_TIME     = 30 * time.Second
+	INPUT_SATURATED_TIME = 1 * time.Second
+	INPUT_SATURATED_FRAC = 0.999 // Of full scale.
+)
+
+type inputHealthStatus struct {
+	Source             string
+	Status             string
+	Samples            uint64
+	Read_Errors        uint64
+	Consecutive_Errors int
+	Reinits            uint64
+	Last_Error         string
+	Last_Error_Time    time.Time
+	Last_Transition    time.Time // Last pulse counted.
+	Stuck              bool
+	Saturated          bool
+	Absent             bool
+}
+
+type inputHealth struct {
+	status         inputHealthStatus
+	started        time.Time
+	lastMv         float64
+	lastChange     time.Time // When the reading last changed.
+	saturatedSince time.Time // Zero if not at full scale.
+	mu             *sync.Mutex
+}
+
+var health = inputHealth{mu: &sync.Mutex{}}
+
+func (h *inputHealth) start(source string, t time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.status.Source = source
+	h.started = t
+	h.lastChange = t
+}
+
+// Returns the number of consecutive errors.
+func (h *inputHealth) readError(err error, t time.Time) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.status.Read_Errors++
+	h.status.Consecutive_Errors++
+	h.status.Last_Error = err.Error()
+	h.status.Last_Error_Time = t
+	return h.status.Consecutive_Errors
+}
+
+// A good reading. fullScale is 0 if the source doesn't have one worth checking.
+func (h *inputHealth) sample(mv, fullScale float64, t time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.status.Samples++
+	h.status.Consecutive_Errors = 0
+	if mv != h.lastMv {
+		h.lastMv = mv
+		h.lastChange = t
+	}
+	if fullScale > 0 && (mv >= fullScale*INPUT_SATURATED_FRAC || mv <= -fullScale*INPUT_SATURATED_FRAC) {
+		if h.saturatedSince.IsZero() {
+			h.saturatedSince = t
+		}
+	} else {
+		h.saturatedSince = time.Time{}
+	}
+}
+
+// A good read from a counter. Stuck and saturated don't apply.
+func (h *inputHealth) countRead(t time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.status.Samples++
+	h.status.Consecutive_Errors = 0
+	h.lastChange = t
+}
+
+func (h *inputHealth) transition(t time.Time) {
+	h.mu.Lock()
+	h.status.Last_Transition = t
+	h.mu.Unlock()
+}
+
+func (h *inputHealth) reinit() {
+	h.mu.Lock()
+	h.status.Reinits++
+	h.mu.Unlock()
+}
+
+// Current status as of t.
+func (h *inputHealth) evaluate(t time.Time) inputHealthStatus {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s := &h.status
+	s.Stuck = !h.lastChange.IsZero() && t.Sub(h.lastChange) >= INPUT_STUCK_TIME
+	s.Saturated = !h.saturatedSince.IsZero() && t.Sub(h.saturatedSince) >= INPUT_SATURATED_TIME
+	s.Absent = false
+	if globalSettings.InputAbsentSeconds > 0 && !h.started.IsZero() {
+		last := s.Last_Transition
+		if last.Before(h.started) {
+			last = h.started
+		}
+		s.Absent = t.Sub(last) >= time.Duration(globalSettings.InputAbsentSeconds)*time.Second
+	}
+
+	switch {
+	case s.Consecutive_Errors > 0:
+		s.Status = HEALTH_ERROR
+	case s.Stuck:
+		s.Status = HEALTH_STUCK
+	case s.Saturated:
+		s.Status = HEALTH_SATURATED
+	case s.Absent:
+		s.Status = HEALTH_ABSENT
+	default:
+		s.Status = HEALTH_OK
+	}
+	return *s
+}
+
+// GET /health. 503 unless the input is ok.
+func handleHealth(w http.ResponseWriter, req *http.Request) {
+	s := health.evaluate(time.Now())
+	w.Header().Set("Content-Type", "application/json")
+	if s.Status != HEALTH_OK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(&s)
+}
@@ -0,0 +1,140 @@
+/*
+	Copyright (c) 2016 Christopher Young
+	Distributable under the terms of The "BSD New"" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	health_test.go: Stuck, saturated and absent input detection, and the read error status.
+*/
+
+package main
+
+import (
+	"errors"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestHealth(t0 time.Time) *inputHealth {
+	h := &inputHealth{mu: &sync.Mutex{}}
+	h.start("ads1115", t0)
+	return h
+}
+
+func TestHealthStuck(t *testing.T) {
+	t0 := time.Now()
+	h := newTestHealth(t0)
+	h.sample(650, 6144, t0)
+	h.sample(650, 6144, t0.Add(INPUT_STUCK_TIME/2))
+	if s := h.evaluate(t0.Add(INPUT_STUCK_TIME - time.Millisecond)); s.Stuck || s.Status != HEALTH_OK {
+		t.Errorf("stuck before INPUT_STUCK_TIME: %+v", s)
+	}
+	if s := h.evaluate(t0.Add(INPUT_STUCK_TIME)); !s.Stuck || s.Status != HEALTH_STUCK {
+		t.Errorf("identical readings for INPUT_STUCK_TIME: %+v", s)
+	}
+	h.sample(651, 6144, t0.Add(INPUT_STUCK_TIME))
+	if s := h.evaluate(t0.Add(INPUT_STUCK_TIME + time.Second)); s.Stuck {
+		t.Errorf("still stuck after a change: %+v", s)
+	}
+
+	// Counter inputs move lastChange on every good read.
+	h = newTestHealth(t0)
+	h.countRead(t0.Add(INPUT_STUCK_TIME))
+	if s := h.evaluate(t0.Add(INPUT_STUCK_TIME + time.Second)); s.Stuck {
+		t.Errorf("counter input stuck: %+v", s)
+	}
+}
+
+func TestHealthSaturated(t *testing.T) {
+	t0 := time.Now()
+	h := newTestHealth(t0)
+	for i := 0; i <= 10; i++ {
+		h.sample(6143+float64(i%2)/2, 6144, t0.Add(time.Duration(i)*INPUT_SATURATED_TIME/10))
+	}
+	if s := h.evaluate(t0.Add(INPUT_SATURATED_TIME)); !s.Saturated || s.Status != HEALTH_SATURATED {
+		t.Errorf("at full scale for INPUT_SATURATED_TIME: %+v", s)
+	}
+	// Negative full scale counts too; a reading inside the range clears it.
+	h.sample(-6144, 6144, t0.Add(2*INPUT_SATURATED_TIME))
+	h.sample(5000, 6144, t0.Add(2*INPUT_SATURATED_TIME+time.Millisecond))
+	if s := h.evaluate(t0.Add(3 * INPUT_SATURATED_TIME)); s.Saturated {
+		t.Errorf("saturated after an in-range reading: %+v", s)
+	}
+
+	// No full scale (MCP3008 style sources): never saturated.
+	h = newTestHealth(t0)
+	h.sample(1e6, 0, t0)
+	h.sample(1e6+1, 0, t0.Add(2*INPUT_SATURATED_TIME))
+	if s := h.evaluate(t0.Add(2 * INPUT_SATURATED_TIME)); s.Saturated {
+		t.Errorf("saturated without a full scale: %+v", s)
+	}
+}
+
+func TestHealthAbsent(t *testing.T) {
+	saved := globalSettings
+	defer func() { globalSettings = saved }()
+	globalSettings.InputAbsentSeconds = 60
+
+	t0 := time.Now()
+	h := newTestHealth(t0)
+	h.countRead(t0.Add(59 * time.Second))
+	if s := h.evaluate(t0.Add(59 * time.Second)); s.Absent {
+		t.Errorf("absent within InputAbsentSeconds of start: %+v", s)
+	}
+	h.countRead(t0.Add(60 * time.Second))
+	if s := h.evaluate(t0.Add(60 * time.Second)); !s.Absent || s.Status != HEALTH_ABSENT {
+		t.Errorf("no pulses since start: %+v", s)
+	}
+	h.transition(t0.Add(61 * time.Second))
+	if s := h.evaluate(t0.Add(100 * time.Second)); s.Absent {
+		t.Errorf("absent 39s after a pulse: %+v", s)
+	}
+	if s := h.evaluate(t0.Add(121 * time.Second)); !s.Absent {
+		t.Errorf("not absent 60s after the last pulse: %+v", s)
+	}
+
+	globalSettings.InputAbsentSeconds = 0
+	if s := h.evaluate(t0.Add(time.Hour)); s.Absent {
+		t.Errorf("absent with the check off: %+v", s)
+	}
+}
+
+func TestHealthErrors(t *testing.T) {
+	t0 := time.Now()
+	h := newTestHealth(t0)
+	if n := h.readError(errors.New("i2c nak"), t0); n != 1 {
+		t.Errorf("first error: %d consecutive", n)
+	}
+	if n := h.readError(errors.New("i2c nak"), t0); n != 2 {
+		t.Errorf("second error: %d consecutive", n)
+	}
+	h.reinit()
+	s := h.evaluate(t0)
+	if s.Status != HEALTH_ERROR || s.Read_Errors != 2 || s.Reinits != 1 || s.Last_Error != "i2c nak" {
+		t.Errorf("after errors: %+v", s)
+	}
+	h.sample(650, 6144, t0)
+	if s := h.evaluate(t0); s.Status != HEALTH_OK || s.Consecutive_Errors != 0 || s.Read_Errors != 2 {
+		t.Errorf("after a good read: %+v", s)
+	}
+}
+
+func TestHandleHealth(t *testing.T) {
+	saved := health
+	defer func() { health = saved }()
+
+	health = *newTestHealth(time.Now())
+	rec := httptest.NewRecorder()
+	handleHealth(rec, httptest.NewRequest("GET", "/health", nil))
+	if rec.Code != 200 {
+		t.Errorf("healthy input: %d", rec.Code)
+	}
+	health.readError(errors.New("i2c nak"), time.Now())
+	rec = httptest.NewRecorder()
+	handleHealth(rec, httptest.NewRequest("GET", "/health", nil))
+	if rec.Code != 503 {
+		t.Errorf("failing input: %d", rec.Code)
+	}
+}
@@ -0,0 +1,66 @@
+/*
+	Copyright (c) 2016 Christopher Young
+	Distributable under the terms of The "BSD New"" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	history.go: Historical flow data from the SQLite database for the dashboard.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	HISTORY_DEFAULT_MINUTES = 120
+	HISTORY_MAX_MINUTES     = 366 * 24 * 60
+	HISTORY_MINUTE_MAX      = 12 * 60 // Longer ranges are served from the hourly rollup.
+)
+
+type historyPoint struct {
+	Time int64   // Start of the bucket, unix seconds.
+	GPH  float64 // Average flow over the bucket.
+}
+
+// Average flow for the last N minutes, at a resolution picked by the storage backend.
+func queryHistory(minutes int) ([]historyPoint, error) {
+	ret := make([]historyPoint, 0)
+	now := time.Now()
+	_, err := withFuelStore(func(st storage) error {
+		var err error
+		ret, err = st.History(now.Add(-time.Duration(minutes)*time.Minute), now)
+		return err
+	})
+	return ret, err
+}
+
+// GET /history?minutes=N.
+func handleHistory(w http.ResponseWriter, req *http.Request) {
+	minutes := HISTORY_DEFAULT_MINUTES
+	if s := req.URL.Query().Get("minutes"); len(s) > 0 {
+		m, err := strconv.Atoi(s)
+		if err != nil || m <= 0 {
+			http.Error(w, "invalid minutes", http.StatusBadRequest)
+			return
+		}
+		if m > HISTORY_MAX_MINUTES {
+			m = HISTORY_MAX_MINUTES
+		}
+		minutes = m
+	}
+
+	points, err := queryHistory(minutes)
+	if err != nil {
+		logger.Errorf("queryHistory(): %s\n", err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(points)
+}
@@ -0,0 +1,254 @@
+/*
+	Copyright (c) 2016 Christopher Young
+	Distributable under the terms of The "BSD New"" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	influx.go: InfluxDB line protocol export of the per-second flow samples, over HTTP or UDP.
+		Batches that can't be sent are appended to an on-disk backlog and retried later. Batches the
+		server rejects outright (4xx) are moved to a quarantine file next to it instead.
+*/
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	INFLUX_HTTP_TIMEOUT    = 10 * time.Second
+	INFLUX_UDP_PAYLOAD_MAX = 1400 // Keep datagrams under a typical MTU.
+	INFLUX_RETRY_CHUNK     = 5000 // Lines per request when draining the backlog.
+)
+
+var influxChan chan fuel_log
+
+// Non-2xx HTTP response to a write.
+type influxHTTPError struct {
+	status string
+	code   int
+	body   string
+}
+
+func (e *influxHTTPError) Error() string {
+	return fmt.Sprintf("influx write: %s: %s", e.status, e.body)
+}
+
+// The server won't take the data however often it's sent (bad line, auth, missing database).
+// Timeouts and rate limiting are worth retrying.
+func influxRejected(err error) bool {
+	e, ok := err.(*influxHTTPError)
+	return ok && e.code/100 == 4 && e.code != http.StatusRequestTimeout && e.code != http.StatusTooManyRequests
+}
+
+func influxQuarantineFile() string {
+	return globalSettings.InfluxBacklogFile + ".rejected"
+}
+
+var influxEscaper = strings.NewReplacer(",", "\\,", " ", "\\ ", "=", "\\=")
+
+// Measurement and tags, built once from the settings.
+func influxSeriesKey() string {
+	key := influxEscaper.Replace(globalSettings.InfluxMeasurement)
+	names := make([]string, 0, len(globalSettings.InfluxTags))
+	for k := range globalSettings.InfluxTags {
+		names = append(names, k)
+	}
+	sort.Strings(names) // Influx prefers tags sorted by key.
+	for _, k := range names {
+		key += "," + influxEscaper.Replace(k) + "=" + influxEscaper.Replace(globalSettings.InfluxTags[k])
+	}
+	return key
+}
+
+func influxLine(seriesKey string, f fuel_log) string {
+	gph := float64(0)
+	if secs := f.log_date_end.Sub(f.log_date_start).Seconds(); secs > 0 {
+		gph = f.flow / secs * float64(3600.0)
+	}
+	return fmt.Sprintf("%s flow=%g,gph=%g,pulses=%di,k_factor=%g %d\n", seriesKey, f.flow, gph, f.pulses, f.k_factor, f.log_date_end.UnixNano())
+}
+
+func influxSendHTTP(data []byte) error {
+	client := http.Client{Timeout: INFLUX_HTTP_TIMEOUT}
+	req, err := http.NewRequest("POST", globalSettings.InfluxURL, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if len(globalSettings.InfluxToken) > 0 {
+		req.Header.Set("Authorization", "Token "+globalSettings.InfluxToken)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return &influxHTTPError{status: resp.Status, code: resp.StatusCode, body: strings.TrimSpace(string(body))}
+	}
+	return nil
+}
+
+// UDP has no acknowledgement, so this only fails if the network is down.
+func influxSendUDP(data []byte) error {
+	conn, err := net.Dial("udp", globalSettings.InfluxUDPAddr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	for len(data) > 0 {
+		n := len(data)
+		if n > INFLUX_UDP_PAYLOAD_MAX {
+			// Split on a line boundary.
+			n = bytes.LastIndexByte(data[:INFLUX_UDP_PAYLOAD_MAX], '\n') + 1
+			if n <= 0 {
+				n = bytes.IndexByte(data, '\n') + 1
+				if n <= 0 {
+					n = len(data)
+				}
+			}
+		}
+		if _, err := conn.Write(data[:n]); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+func influxSend(data []byte) error {
+	if len(globalSettings.InfluxURL) > 0 {
+		return influxSendHTTP(data)
+	}
+	return influxSendUDP(data)
+}
+
+// Append an unsent batch to the backlog file, unless it has grown past InfluxBacklogMaxBytes.
+func influxBacklogAppend(data []byte) {
+	influxAppendFile(globalSettings.InfluxBacklogFile, data)
+}
+
+// Keep a rejected batch for inspection, out of the retry path.
+func influxQuarantine(data []byte, err error) {
+	logger.Errorf("influx rejected %d bytes, moved to '%s': %s\n", len(data), influxQuarantineFile(), err.Error())
+	influxAppendFile(influxQuarantineFile(), data)
+}
+
+func influxAppendFile(path string, data []byte) {
+	if fi, err := os.Stat(path); err == nil && fi.Size()+int64(len(data)) > globalSettings.InfluxBacklogMaxBytes {
+		logger.Errorf("influx backlog '%s' full, dropping %d bytes.\n", path, len(data))
+		return
+	}
+
+	fp, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		logger.Errorf("can't open influx backlog '%s': %s\n", path, err.Error())
+		return
+	}
+	defer fp.Close()
+	if _, err := fp.Write(data); err != nil {
+		logger.Errorf("influx backlog write: %s\n", err.Error())
+		return
+	}
+	fp.Sync()
+}
+
+// Try to send the backlog. Rejected chunks are quarantined, whatever can't be sent yet is written back.
+func influxBacklogRetry() {
+	data, err := ioutil.ReadFile(globalSettings.InfluxBacklogFile)
+	if err != nil || len(data) == 0 {
+		return
+	}
+
+	lines := bytes.SplitAfter(data, []byte("\n"))
+	sent := 0
+	for sent < len(lines) {
+		end := sent + INFLUX_RETRY_CHUNK
+		if end > len(lines) {
+			end = len(lines)
+		}
+		chunk := bytes.Join(lines[sent:end], nil)
+		if err := influxSend(chunk); err != nil {
+			if !influxRejected(err) {
+				break
+			}
+			influxQuarantine(chunk, err)
+		}
+		sent = end
+	}
+	if sent == 0 {
+		return
+	}
+	logger.Debugf("cleared %d backlogged influx lines.\n", sent)
+
+	// Write the remainder to a new file and swap it in.
+	tmp := globalSettings.InfluxBacklogFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, bytes.Join(lines[sent:], nil), 0644); err != nil {
+		logger.Errorf("influx backlog rewrite: %s\n", err.Error())
+		return
+	}
+	if err := os.Rename(tmp, globalSettings.InfluxBacklogFile); err != nil {
+		logger.Errorf("influx backlog rewrite: %s\n", err.Error())
+	}
+}
+
+// Batches samples from influxChan and exports them. Runs only if InfluxURL or InfluxUDPAddr is set.
+// Returns once influxChan has been closed and the last batch is sent (or backlogged).
+func influxExporter() {
+	seriesKey := influxSeriesKey()
+	ticker := time.NewTicker(time.Duration(globalSettings.InfluxFlushSeconds) * time.Second)
+	defer ticker.Stop()
+
+	var batch bytes.Buffer
+	batchLines := 0
+	backlogged := true // Check for a backlog left from a previous run.
+
+	flush := func() {
+		if batchLines == 0 {
+			return
+		}
+		if err := influxSend(batch.Bytes()); influxRejected(err) {
+			influxQuarantine(batch.Bytes(), err)
+		} else if err != nil {
+			logger.Errorf("influx export: %s\n", err.Error())
+			influxBacklogAppend(batch.Bytes())
+			backlogged = true
+		}
+		batch.Reset()
+		batchLines = 0
+	}
+
+	for {
+		select {
+		case f, ok := <-influxChan:
+			if !ok {
+				flush()
+				return
+			}
+			batch.WriteString(influxLine(seriesKey, f))
+			batchLines++
+			if batchLines >= globalSettings.InfluxBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+			if backlogged {
+				influxBacklogRetry()
+				if fi, err := os.Stat(globalSettings.InfluxBacklogFile); err != nil || fi.Size() == 0 {
+					backlogged = false
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,89 @@
+/*
+	Copyright (c) 2016 Christopher Young
+	Distributable under the terms of The "BSD New"" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	influx_test.go: Backlog retry against a server that rejects or fails writes.
+*/
+
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestInfluxBacklogRetry(t *testing.T) {
+	saved := globalSettings
+	defer func() { globalSettings = saved }()
+
+	status := http.StatusBadRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		if status == http.StatusBadRequest && strings.Contains(string(body), "bad") {
+			http.Error(w, "unable to parse", status)
+			return
+		}
+		if status != http.StatusBadRequest {
+			http.Error(w, "unavailable", status)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	globalSettings.InfluxURL = srv.URL
+	globalSettings.InfluxBacklogFile = filepath.Join(dir, "backlog.txt")
+	globalSettings.InfluxBacklogMaxBytes = 1 << 20
+	read := func(path string) string {
+		buf, _ := ioutil.ReadFile(path)
+		return string(buf)
+	}
+
+	// Server down: everything stays in the backlog.
+	status = http.StatusServiceUnavailable
+	influxBacklogAppend([]byte("fuel_flow flow=1 1\nfuel_flow bad 2\n"))
+	influxBacklogRetry()
+	if got := read(globalSettings.InfluxBacklogFile); got != "fuel_flow flow=1 1\nfuel_flow bad 2\n" {
+		t.Errorf("backlog after a 503: %q", got)
+	}
+	if got := read(influxQuarantineFile()); got != "" {
+		t.Errorf("quarantined after a 503: %q", got)
+	}
+
+	// Server up, rejecting the chunk: out of the backlog into quarantine, not retried forever.
+	status = http.StatusBadRequest
+	influxBacklogRetry()
+	if got := read(globalSettings.InfluxBacklogFile); got != "" {
+		t.Errorf("backlog after a 400: %q", got)
+	}
+	if got := read(influxQuarantineFile()); !strings.Contains(got, "fuel_flow bad 2\n") {
+		t.Errorf("quarantine after a 400: %q", got)
+	}
+}
+
+func TestInfluxRejected(t *testing.T) {
+	for code, want := range map[int]bool{
+		http.StatusBadRequest:          true,
+		http.StatusUnauthorized:        true,
+		http.StatusNotFound:            true,
+		http.StatusRequestTimeout:      false,
+		http.StatusTooManyRequests:     false,
+		http.StatusInternalServerError: false,
+		http.StatusServiceUnavailable:  false,
+	} {
+		if got := influxRejected(&influxHTTPError{code: code}); got != want {
+			t.Errorf("influxRejected(%d) = %v, want %v", code, got, want)
+		}
+	}
+	if influxRejected(nil) || influxRejected(errors.New("connection refused")) {
+		t.Error("non-HTTP error treated as rejected")
+	}
+}
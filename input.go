@@ -0,0 +1,191 @@
+/*
+	Copyright (c) 2016 Christopher Young
+	Distributable under the terms of The "BSD New"" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	input.go: Flow transducer input. Sources register themselves in inputSources and are picked
+		by InputSource: "ads1115", "ads1015", "mcp3008" (ADCs, sampled and edge-detected by
+		processInput()) or "pcf8583" (pulse counter chip).
+*/
+
+package main
+
+import (
+	"context"
+	"github.com/kidoman/embd"
+	"time"
+)
+
+const (
+	SAMPLE_POLL_INTERVAL = 500 * time.Microsecond // Oversampling of ADCs without a ready signal.
+	PULSE_POLL_INTERVAL  = 100 * time.Millisecond
+	INPUT_REOPEN_DELAY   = 1 * time.Second
+)
+
+// I2C bus 1 for the inputs. embd keeps one bus per number and won't open it again once closed, so
+// the inputs never close it: a re-init reconfigures the device on the bus that's already open.
+type sharedI2CBus struct {
+	embd.I2CBus
+}
+
+func (sharedI2CBus) Close() error {
+	return nil
+}
+
+func systemI2CBus() sharedI2CBus {
+	return sharedI2CBus{embd.NewI2CBus(1)}
+}
+
+type flowInput interface {
+	close() error
+}
+
+// One ADC reading. Time is when the conversion was taken, not when it was processed, and carries
+// the monotonic clock reading from time.Now() so intervals between samples ignore wall clock steps.
+type inputSample struct {
+	Time       time.Time
+	Millivolts float64
+}
+
+// ADC input: the transducer's open collector output, in mV.
+type sampleSource interface {
+	flowInput
+	// Next sample. Paces the caller.
+	readSample() (inputSample, error)
+}
+
+// Sources whose readings can be checked for saturation.
+type fullScaler interface {
+	fullScaleMillivolts() float64
+}
+
+// Counter chip input.
+type pulseSource interface {
+	flowInput
+	// Pulses counted since the last call.
+	readPulses() (uint64, error)
+}
+
+// Source constructors by name. ctx cancels any retrying during setup.
+var inputSources = make(map[string]func(ctx context.Context) (flowInput, error))
+
+// n pulses counted at sample time t.
+func countPulses(n uint64, t time.Time) {
+	inputClock.set(t)
+	if n > 0 {
+		health.transition(t)
+	}
+	pulses.add(n, t)
+}
+
+// Reads the configured input until ctx is cancelled, then closes inputChan. The source (bus and
+// device) is closed and opened again after InputReinitErrors consecutive read errors.
+func readInput(ctx context.Context) {
+	go processInput()
+	go statsCalculator()
+	defer close(inputChan)
+
+	name := globalSettings.InputSource
+	open, ok := inputSources[name]
+	if !ok {
+		logger.Errorf("unknown InputSource '%s'.\n", name)
+		return
+	}
+	health.start(name, time.Now())
+
+	for {
+		in, err := open(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			logger.Errorf("%s: %s\n", name, err.Error())
+			health.readError(err, time.Now())
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(INPUT_REOPEN_DELAY):
+			}
+			continue
+		}
+
+		switch src := in.(type) {
+		case sampleSource:
+			runSamples(ctx, src)
+		case pulseSource:
+			runPulses(ctx, src)
+		}
+		if err := in.close(); err != nil {
+			logger.Errorf("%s close: %s\n", name, err.Error())
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		logger.Errorf("%s: %d consecutive read errors, reinitializing.\n", name, globalSettings.InputReinitErrors)
+		health.reinit()
+	}
+}
+
+// Returns when ctx is cancelled, or after InputReinitErrors consecutive errors.
+func runSamples(ctx context.Context, src sampleSource) {
+	fullScale := float64(0)
+	if fs, ok := src.(fullScaler); ok {
+		fullScale = fs.fullScaleMillivolts()
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+
+		s, err := src.readSample()
+		if err != nil {
+			metrics.i2cError()
+			n := health.readError(err, time.Now())
+			if n == 1 {
+				logger.Errorf("%s read: %s\n", globalSettings.InputSource, err.Error())
+			}
+			if n >= globalSettings.InputReinitErrors {
+				return
+			}
+			continue
+		}
+		metrics.sampleRead()
+		health.sample(s.Millivolts, fullScale, s.Time)
+
+		inputChan <- s
+	}
+}
+
+// Returns when ctx is cancelled, or after InputReinitErrors consecutive errors.
+func runPulses(ctx context.Context, src pulseSource) {
+	ticker := time.NewTicker(PULSE_POLL_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		n, err := src.readPulses()
+		t := time.Now() // The chip counts continuously; the read is the sample.
+		if err != nil {
+			metrics.i2cError()
+			c := health.readError(err, t)
+			if c == 1 {
+				logger.Errorf("%s read: %s\n", globalSettings.InputSource, err.Error())
+			}
+			if c >= globalSettings.InputReinitErrors {
+				return
+			}
+			continue
+		}
+		metrics.sampleRead()
+		health.countRead(t)
+		countPulses(n, t)
+	}
+}
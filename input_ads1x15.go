@@ -0,0 +1,125 @@
+/*
+	Copyright (c) 2016 Christopher Young
+	Distributable under the terms of The "BSD New"" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	input_ads1x15.go: ADS1115/ADS1015 flow input on A0-A1, with the optional ALERT/RDY pin and
+		supply voltage monitor.
+*/
+
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// Flow input: differential A0-A1, continuous at the fastest rate. Gain is set from ADSFullScaleMillivolts.
+var adsFlowConfig = adsConfig{
+	Rate:       ADS_RATE_860,
+	Gain:       ADS_PGA_6144,
+	Mux:        ADS_MUX_P0_N1,
+	Mode:       ADS_MODE_CONTINUOUS,
+	Comparator: adsComparator{Queue: ADS_COMP_QUEUE_DISABLE},
+}
+
+type adsSource struct {
+	adc         *ads1115
+	ready       *adsReady // nil: timed polling.
+	gain        adsGain
+	stopMonitor context.CancelFunc
+}
+
+func init() {
+	inputSources["ads1115"] = func(ctx context.Context) (flowInput, error) {
+		return openADSSource(ctx, newADS1115)
+	}
+	inputSources["ads1015"] = func(ctx context.Context) (flowInput, error) {
+		return openADSSource(ctx, newADS1015)
+	}
+}
+
+func openADSSource(ctx context.Context, newADC func(i2cBus, byte) (*ads1115, error)) (flowInput, error) {
+	adc, err := newADC(systemI2CBus(), byte(globalSettings.ADSAddress))
+	if err != nil {
+		return nil, err
+	}
+	s := &adsSource{adc: adc, stopMonitor: func() {}}
+
+	// One read per conversion if ALERT/RDY is wired, otherwise timed polling.
+	cfg := adsFlowConfig
+	cfg.Gain, _ = adsGainFor(globalSettings.ADSFullScaleMillivolts) // Checked by readSettings().
+	s.gain = cfg.Gain
+	if globalSettings.ADSReadyGPIO != ADS_READY_GPIO_OFF {
+		if s.ready, err = openADSReady(globalSettings.ADSReadyGPIO); err != nil {
+			logger.Errorf("ALERT/RDY on GPIO %d: %s, using timed polling.\n", globalSettings.ADSReadyGPIO, err.Error())
+			s.ready = nil
+		} else {
+			cfg.Comparator.Queue = ADS_COMP_QUEUE_1
+		}
+	}
+
+	// Keep trying until the device answers with the config we wrote.
+	for {
+		err := adc.configure(cfg)
+		if err == nil && s.ready != nil {
+			err = adc.enableReady()
+		}
+		if err == nil {
+			break
+		}
+		logger.Errorf("%s configure: %s\n", adc.model, err.Error())
+		metrics.i2cError()
+		health.readError(err, time.Now())
+		select {
+		case <-ctx.Done():
+			s.close()
+			return nil, ctx.Err()
+		case <-time.After(1 * time.Second):
+		}
+	}
+
+	if globalSettings.SupplyMonitorChannel >= 0 {
+		m := &supplyMonitor{
+			src:      &adsSupplySource{adc: adc, channel: globalSettings.SupplyMonitorChannel, scale: globalSettings.SupplyMonitorScale},
+			lowVolts: globalSettings.SupplyMonitorLowVolts,
+		}
+		var mctx context.Context
+		mctx, s.stopMonitor = context.WithCancel(ctx)
+		go m.run(mctx, time.Duration(globalSettings.SupplyMonitorIntervalMs)*time.Millisecond)
+	}
+	return s, nil
+}
+
+// Stamped with the ALERT/RDY edge if there is one, otherwise just before the read.
+func (s *adsSource) readSample() (inputSample, error) {
+	var t time.Time
+	if s.ready != nil {
+		var ok bool
+		if t, ok = s.ready.wait(ADS_READY_TIMEOUT); !ok {
+			logger.Errorf("no ALERT/RDY edge in %s, falling back to timed polling.\n", ADS_READY_TIMEOUT)
+			s.ready.close()
+			s.ready = nil
+		}
+	}
+	if s.ready == nil {
+		time.Sleep(SAMPLE_POLL_INTERVAL)
+		t = time.Now()
+	}
+
+	v, err := s.adc.readConversion()
+	return inputSample{Time: t, Millivolts: s.gain.millivolts(v)}, err
+}
+
+func (s *adsSource) fullScaleMillivolts() float64 {
+	return s.gain.fullScale()
+}
+
+func (s *adsSource) close() error {
+	s.stopMonitor()
+	if s.ready != nil {
+		s.ready.close()
+	}
+	return s.adc.close()
+}
@@ -0,0 +1,221 @@
+/*
+	Copyright (c) 2016 Christopher Young
+	Distributable under the terms of The "BSD New"" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	journal.go: Crash-safe write-ahead journal for flow samples.
+		Every sample is appended and fsync'd before it is batched for storage, so power loss
+		(master-off) loses nothing. Once a batch is in storage the journal is checkpointed down
+		to a single record holding the latest totalizer value. On startup the journal is replayed
+		into storage and the totalizer is restored from it.
+
+		Record: [4 payload length][4 CRC-32 of type+payload][1 type][payload], big endian.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	JOURNAL_RECORD_SAMPLE    = 1
+	JOURNAL_RECORD_TOTALIZER = 2
+
+	JOURNAL_HEADER_LEN = 9
+	JOURNAL_MAX_RECORD = 1024 // Anything longer is corruption.
+)
+
+var errJournalCorrupt = errors.New("corrupt journal record")
+
+type flowJournal struct {
+	fp   *os.File
+	path string
+	mu   *sync.Mutex
+}
+
+var journal *flowJournal // nil if the journal couldn't be opened.
+
+func encodeJournalRecord(typ byte, payload []byte) []byte {
+	buf := make([]byte, JOURNAL_HEADER_LEN+len(payload))
+	binary.BigEndian.PutUint32(buf[0:], uint32(len(payload)))
+	buf[8] = typ
+	copy(buf[JOURNAL_HEADER_LEN:], payload)
+	binary.BigEndian.PutUint32(buf[4:], crc32.ChecksumIEEE(buf[8:]))
+	return buf
+}
+
+func encodeJournalSample(f fuel_log) []byte {
+	var p [48]byte
+	binary.BigEndian.PutUint64(p[0:], uint64(f.log_date_start.UnixNano()))
+	binary.BigEndian.PutUint64(p[8:], uint64(f.log_date_end.UnixNano()))
+	binary.BigEndian.PutUint64(p[16:], f.pulses)
+	binary.BigEndian.PutUint64(p[24:], math.Float64bits(f.k_factor))
+	binary.BigEndian.PutUint64(p[32:], math.Float64bits(f.flow))
+	binary.BigEndian.PutUint64(p[40:], math.Float64bits(f.fuel_remaining))
+	return encodeJournalRecord(JOURNAL_RECORD_SAMPLE, p[:])
+}
+
+func encodeJournalTotalizer(t time.Time, remaining float64) []byte {
+	var p [16]byte
+	binary.BigEndian.PutUint64(p[0:], uint64(t.UnixNano()))
+	binary.BigEndian.PutUint64(p[8:], math.Float64bits(remaining))
+	return encodeJournalRecord(JOURNAL_RECORD_TOTALIZER, p[:])
+}
+
+// Read one record. io.EOF at a clean end, errJournalCorrupt for a torn or damaged record.
+func readJournalRecord(r io.Reader) (byte, []byte, error) {
+	var hdr [JOURNAL_HEADER_LEN]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		if err == io.EOF {
+			return 0, nil, io.EOF
+		}
+		return 0, nil, errJournalCorrupt
+	}
+	n := binary.BigEndian.Uint32(hdr[0:])
+	if n > JOURNAL_MAX_RECORD {
+		return 0, nil, errJournalCorrupt
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, errJournalCorrupt
+	}
+	crc := crc32.NewIEEE()
+	crc.Write(hdr[8:])
+	crc.Write(payload)
+	if crc.Sum32() != binary.BigEndian.Uint32(hdr[4:]) {
+		return 0, nil, errJournalCorrupt
+	}
+	return hdr[8], payload, nil
+}
+
+// Open (or create) the journal at path. Returns the samples it holds and the latest totalizer
+// value, if there is one. A damaged tail is cut off.
+func openJournal(path string) (*flowJournal, []fuel_log, float64, bool, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, nil, 0, false, err
+	}
+
+	samples := make([]fuel_log, 0)
+	remaining := float64(0)
+	haveTotalizer := false
+	r := bytes.NewReader(data)
+	good := 0
+	for {
+		typ, p, err := readJournalRecord(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			logger.Errorf("journal '%s': %s at offset %d, discarding the rest.\n", path, err.Error(), good)
+			break
+		}
+		switch {
+		case typ == JOURNAL_RECORD_SAMPLE && len(p) == 48:
+			f := fuel_log{
+				log_date_start: time.Unix(0, int64(binary.BigEndian.Uint64(p[0:]))),
+				log_date_end:   time.Unix(0, int64(binary.BigEndian.Uint64(p[8:]))),
+				pulses:         binary.BigEndian.Uint64(p[16:]),
+				k_factor:       math.Float64frombits(binary.BigEndian.Uint64(p[24:])),
+				flow:           math.Float64frombits(binary.BigEndian.Uint64(p[32:])),
+				fuel_remaining: math.Float64frombits(binary.BigEndian.Uint64(p[40:])),
+			}
+			samples = append(samples, f)
+			remaining = f.fuel_remaining
+			haveTotalizer = true
+		case typ == JOURNAL_RECORD_TOTALIZER && len(p) == 16:
+			remaining = math.Float64frombits(binary.BigEndian.Uint64(p[8:]))
+			haveTotalizer = true
+		default:
+			logger.Errorf("journal '%s': unknown record type %d.\n", path, typ)
+		}
+		good = len(data) - r.Len()
+	}
+
+	fp, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, nil, 0, false, err
+	}
+	// Drop a torn tail so new records follow the last good one.
+	if err := fp.Truncate(int64(good)); err != nil {
+		fp.Close()
+		return nil, nil, 0, false, err
+	}
+	if _, err := fp.Seek(int64(good), io.SeekStart); err != nil {
+		fp.Close()
+		return nil, nil, 0, false, err
+	}
+
+	return &flowJournal{fp: fp, path: path, mu: &sync.Mutex{}}, samples, remaining, haveTotalizer, nil
+}
+
+// Append a sample and fsync.
+func (j *flowJournal) append(f fuel_log) error {
+	if j == nil {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if _, err := j.fp.Write(encodeJournalSample(f)); err != nil {
+		return err
+	}
+	return j.fp.Sync()
+}
+
+// Everything journaled so far is in storage. Replace the journal with a single totalizer record.
+func (j *flowJournal) checkpoint(remaining float64) error {
+	if j == nil {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	tmp := j.path + ".tmp"
+	fp, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := fp.Write(encodeJournalTotalizer(time.Now(), remaining)); err != nil {
+		fp.Close()
+		return err
+	}
+	if err := fp.Sync(); err != nil {
+		fp.Close()
+		return err
+	}
+	if err := os.Rename(tmp, j.path); err != nil {
+		fp.Close()
+		return err
+	}
+	// Make the rename itself durable.
+	if dir, err := os.Open(filepath.Dir(j.path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+
+	j.fp.Close()
+	j.fp = fp
+	return nil
+}
+
+func (j *flowJournal) close() error {
+	if j == nil {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.fp.Sync()
+	return j.fp.Close()
+}
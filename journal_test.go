@@ -0,0 +1,186 @@
+/*
+	Copyright (c) 2016 Christopher Young
+	Distributable under the terms of The "BSD New"" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	journal_test.go: Journal replay, damaged records, torn tails and checkpoints.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func journalSample(i int) fuel_log {
+	t := time.Unix(1700000000+int64(i), 0)
+	return fuel_log{log_date_start: t, log_date_end: t.Add(time.Second), pulses: uint64(10 + i), k_factor: 68000, flow: float64(10+i) / 68000, fuel_remaining: 40 - float64(i)/10}
+}
+
+func writeJournal(t *testing.T, path string, n int) {
+	j, _, _, _, err := openJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		if err := j.append(journalSample(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := j.close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestJournalReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "flowfast.journal")
+	j, samples, _, ok, err := openJournal(path)
+	if err != nil || len(samples) != 0 || ok {
+		t.Fatalf("new journal: %d samples, totalizer %v, %v", len(samples), ok, err)
+	}
+	j.close()
+
+	writeJournal(t, path, 3)
+	j, samples, remaining, ok, err := openJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.close()
+	if len(samples) != 3 {
+		t.Fatalf("replayed %d samples, want 3", len(samples))
+	}
+	for i, f := range samples {
+		want := journalSample(i)
+		if !f.log_date_start.Equal(want.log_date_start) || !f.log_date_end.Equal(want.log_date_end) || f.pulses != want.pulses ||
+			f.k_factor != want.k_factor || f.flow != want.flow || f.fuel_remaining != want.fuel_remaining {
+			t.Errorf("sample %d replayed as %+v, want %+v", i, f, want)
+		}
+	}
+	if !ok || remaining != journalSample(2).fuel_remaining {
+		t.Errorf("totalizer %g (%v), want the last sample's", remaining, ok)
+	}
+}
+
+// A flipped bit in the second record: the first survives, the rest is cut off, and new records
+// follow the good one.
+func TestJournalCRCMismatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "flowfast.journal")
+	writeJournal(t, path, 3)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := len(encodeJournalSample(journalSample(0)))
+	data[rec+JOURNAL_HEADER_LEN+3] ^= 0x01
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	j, samples, _, _, err := openJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(samples) != 1 {
+		t.Errorf("replayed %d samples past a CRC mismatch, want 1", len(samples))
+	}
+	if err := j.append(journalSample(5)); err != nil {
+		t.Fatal(err)
+	}
+	j.close()
+	if _, samples, _, _, _ = openJournal(path); len(samples) != 2 || samples[1].pulses != journalSample(5).pulses {
+		t.Errorf("after appending past the damage: %d samples", len(samples))
+	}
+}
+
+// Power lost part way through a write: the partial record is truncated off on open.
+func TestJournalTornTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "flowfast.journal")
+	writeJournal(t, path, 2)
+	fi, _ := os.Stat(path)
+	good := fi.Size()
+
+	fp, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fp.Write(encodeJournalSample(journalSample(2))[:20])
+	fp.Close()
+
+	j, samples, _, _, err := openJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.close()
+	if len(samples) != 2 {
+		t.Errorf("replayed %d samples, want 2", len(samples))
+	}
+	if fi, _ := os.Stat(path); fi.Size() != good {
+		t.Errorf("journal is %d bytes after open, want the torn tail cut to %d", fi.Size(), good)
+	}
+
+	// A header claiming an impossible length is treated the same way.
+	fp, _ = os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	fp.Write([]byte{0xFF, 0xFF, 0xFF, 0xFF, 0, 0, 0, 0, JOURNAL_RECORD_SAMPLE})
+	fp.Close()
+	if j, samples, _, _, err = openJournal(path); err != nil || len(samples) != 2 {
+		t.Errorf("oversized record: %d samples, %v", len(samples), err)
+	}
+	j.close()
+}
+
+func TestJournalCheckpoint(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "flowfast.journal")
+	writeJournal(t, path, 4)
+	j, samples, _, _, err := openJournal(path)
+	if err != nil || len(samples) != 4 {
+		t.Fatalf("%d samples, %v", len(samples), err)
+	}
+	if err := j.checkpoint(12.5); err != nil {
+		t.Fatal(err)
+	}
+	if fi, _ := os.Stat(path); fi.Size() != int64(len(encodeJournalTotalizer(time.Now(), 0))) {
+		t.Errorf("checkpointed journal is %d bytes, want a single totalizer record", fi.Size())
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("checkpoint left its temporary file: %v", err)
+	}
+
+	// Appends after the checkpoint go to the new file.
+	if err := j.append(journalSample(9)); err != nil {
+		t.Fatal(err)
+	}
+	j.close()
+	j, samples, remaining, ok, err := openJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.close()
+	if len(samples) != 1 || samples[0].pulses != journalSample(9).pulses {
+		t.Errorf("after checkpoint and append: %d samples", len(samples))
+	}
+	if !ok || remaining != journalSample(9).fuel_remaining {
+		t.Errorf("totalizer %g (%v)", remaining, ok)
+	}
+
+	// Checkpoint alone survives a reopen.
+	j, _, _, _, _ = openJournal(path)
+	j.checkpoint(7.25)
+	j.close()
+	j, samples, remaining, ok, err = openJournal(path)
+	if err != nil || len(samples) != 0 || !ok || remaining != 7.25 {
+		t.Errorf("reopened checkpoint: %d samples, totalizer %g (%v), %v", len(samples), remaining, ok, err)
+	}
+	j.close()
+}
+
+func TestJournalNil(t *testing.T) {
+	var j *flowJournal
+	if j.append(journalSample(0)) != nil || j.checkpoint(1) != nil || j.close() != nil {
+		t.Error("nil journal returned an error")
+	}
+}
@@ -2,7 +2,11 @@ package main
 
 import "math"
 
+// Sample standard deviation. 0 for fewer than two values.
 func stdDev(numbers []float64, mean float64) float64 {
+	if len(numbers) < 2 {
+		return 0
+	}
 	total := 0.0
 	for _, number := range numbers {
 		total += math.Pow(number-mean, 2)
@@ -18,18 +22,36 @@ func sum(numbers []float64) (total float64) {
 	return total
 }
 
+// Index of the largest value, -1 if numbers is empty.
 func getSetMax(numbers []float64) int {
-	ret := int(-1)
-	thisMax := float64(0.0)
+	if len(numbers) == 0 {
+		return -1
+	}
+	ret := 0
+	for i, v := range numbers {
+		if v > numbers[ret] {
+			ret = i
+		}
+	}
+	return ret
+}
+
+// Index of the value farthest from mean, either side. -1 if numbers is empty.
+func getFarthest(numbers []float64, mean float64) int {
+	if len(numbers) == 0 {
+		return -1
+	}
+	ret := 0
 	for i, v := range numbers {
-		if v > thisMax {
-			thisMax = v
+		if math.Abs(v-mean) > math.Abs(numbers[ret]-mean) {
 			ret = i
 		}
 	}
 	return ret
 }
 
+// Drops the highest value until the standard deviation is within 50. Returns the mean and standard
+// deviation of what's left. Overwrites numbers.
 func removeOutliers(numbers []float64) (float64, float64) {
 	mean := sum(numbers) / float64(len(numbers))
 	stdev := stdDev(numbers, mean)
@@ -50,3 +72,26 @@ func removeOutliers(numbers []float64) (float64, float64) {
 
 	return mean, stdev
 }
+
+// removeOutliers() for plateaus with spikes either side: drops the values farthest from the mean,
+// high or low. Returns how many values were kept too. Overwrites numbers.
+func removeOutliersTwoSided(numbers []float64) (float64, float64, int) {
+	mean := sum(numbers) / float64(len(numbers))
+	stdev := stdDev(numbers, mean)
+
+	for len(numbers) > 2 && stdev > 50.0 {
+		i := getFarthest(numbers, mean)
+
+		// Delete the element from the array.
+		if i+1 >= len(numbers) {
+			numbers = numbers[:i]
+		} else {
+			numbers = append(numbers[:i], numbers[i+1:]...)
+		}
+
+		mean = sum(numbers) / float64(len(numbers))
+		stdev = stdDev(numbers, mean)
+	}
+
+	return mean, stdev, len(numbers)
+}
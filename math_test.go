@@ -0,0 +1,90 @@
+/*
+	Copyright (c) 2016 Christopher Young
+	Distributable under the terms of The "BSD New"" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	math_test.go: getSetMax(), removeOutliers() on recorded plateaus and removeOutliersTwoSided() on
+		negative and mixed-sign ones.
+*/
+
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestGetSetMax(t *testing.T) {
+	tests := []struct {
+		numbers []float64
+		want    int
+	}{
+		{nil, -1},
+		{[]float64{-5}, 0},
+		{[]float64{-10, -3, -7}, 1},
+		{[]float64{-1, 0, -2}, 1},
+		{[]float64{-4, 2, 9, 9}, 2},
+	}
+	for _, tt := range tests {
+		if got := getSetMax(tt.numbers); got != tt.want {
+			t.Errorf("getSetMax(%v) = %d, want %d", tt.numbers, got, tt.want)
+		}
+	}
+}
+
+func TestRemoveOutliersTwoSided(t *testing.T) {
+	// Low plateau with an offset below 0 mV and spikes either side.
+	negative := make([]float64, 0, 32)
+	for i := 0; i < 32; i++ {
+		negative = append(negative, -10-float64(i%4)*2)
+	}
+	negative[5] = -310
+	negative[20] = -450
+
+	mixed := []float64{-20, -18, -22, -19, 21, 18, 20, 19, -400, 22, -21, 350, 0, 1, -1, 2}
+
+	allFar := make([]float64, 32) // -10 to -310, no plateau at all.
+	for i := range allFar {
+		allFar[i] = -10 - float64(i)*300/31
+	}
+
+	tests := []struct {
+		name      string
+		numbers   []float64
+		wantMean  float64
+		wantKept  int
+		tolerance float64
+	}{
+		{"negative plateau", negative, -13, 30, 0.5},
+		{"mixed sign", mixed, 0.21, 14, 0.5},
+		{"clean", []float64{-3, -2, -4, -3}, -3, 4, 0.01},
+	}
+	for _, tt := range tests {
+		in := append([]float64(nil), tt.numbers...)
+		mean, stdev, kept := removeOutliersTwoSided(in)
+		if kept != tt.wantKept || math.Abs(mean-tt.wantMean) > tt.tolerance || stdev > 50 {
+			t.Errorf("%s: mean %g stdev %g kept %d, want mean %g kept %d", tt.name, mean, stdev, kept, tt.wantMean, tt.wantKept)
+		}
+	}
+
+	// Spread too wide to find a plateau: drops to the closest few, never panics or goes NaN.
+	mean, stdev, kept := removeOutliersTwoSided(allFar)
+	if math.IsNaN(mean) || math.IsNaN(stdev) || kept < 2 || stdev > 50 {
+		t.Errorf("spread: mean %g stdev %g kept %d", mean, stdev, kept)
+	}
+}
+
+// The recorded low plateau (filter_test.go): spikes dropped until the rest is within 50 mV.
+func TestRemoveOutliersRecorded(t *testing.T) {
+	mean, stdev := removeOutliers(append([]float64(nil), recordedNoise...))
+	if mean < 655 || mean > 700 || stdev > 50 {
+		t.Errorf("removeOutliers(recordedNoise) = %0.2f, %0.2f", mean, stdev)
+	}
+
+	// The spikes are all high, so dropping either side comes to the same.
+	mean2, stdev2, kept := removeOutliersTwoSided(append([]float64(nil), recordedNoise...))
+	if math.Abs(mean2-mean) > 1 || stdev2 > 50 || kept >= len(recordedNoise) {
+		t.Errorf("removeOutliersTwoSided(recordedNoise) = %0.2f, %0.2f, %d of %d kept", mean2, stdev2, kept, len(recordedNoise))
+	}
+}
@@ -0,0 +1,97 @@
+/*
+	Copyright (c) 2016 Christopher Young
+	Distributable under the terms of The "BSD New"" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	mcp3008.go: MCP3008 8-channel 10-bit SPI ADC driver, and the "mcp3008" flow input.
+
+	Ref: http://ww1.microchip.com/downloads/en/DeviceDoc/21295d.pdf
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/kidoman/embd"
+	"sync"
+	"time"
+)
+
+const (
+	MCP3008_CHANNELS  = 8
+	MCP3008_MAX_CODE  = 1024
+	MCP3008_SPI_SPEED = 1000000 // units=Hz. 1.35MHz max at 2.7V.
+)
+
+// The part of embd.SPIBus the driver uses.
+type spiBus interface {
+	TransferAndReceiveData(dataBuffer []uint8) error
+	Close() error
+}
+
+type mcp3008 struct {
+	bus  spiBus
+	vref float64 // units=mV.
+	mu   *sync.Mutex
+}
+
+func newMCP3008(bus spiBus, vrefMillivolts float64) *mcp3008 {
+	return &mcp3008{bus: bus, vref: vrefMillivolts, mu: &sync.Mutex{}}
+}
+
+// One conversion. Single ended, or differential against the paired input (0-1, 2-3, ...; odd
+// channels are the inverted pair).
+func (d *mcp3008) read(channel int, differential bool) (uint16, error) {
+	if channel < 0 || channel >= MCP3008_CHANNELS {
+		return 0, fmt.Errorf("mcp3008: invalid channel %d", channel)
+	}
+	ctl := uint8(channel) << 4
+	if !differential {
+		ctl |= 0x80
+	}
+	// Start bit, SGL/DIFF + D2..D0, then clock out the 10-bit result.
+	buf := []uint8{0x01, ctl, 0x00}
+
+	d.mu.Lock()
+	err := d.bus.TransferAndReceiveData(buf)
+	d.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	return uint16(buf[1]&0x03)<<8 | uint16(buf[2]), nil
+}
+
+func (d *mcp3008) millivolts(code uint16) float64 {
+	return float64(code) * d.vref / MCP3008_MAX_CODE
+}
+
+func (d *mcp3008) close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.bus.Close()
+}
+
+type mcpSource struct {
+	adc     *mcp3008
+	channel int
+}
+
+func init() {
+	inputSources["mcp3008"] = func(ctx context.Context) (flowInput, error) {
+		bus := embd.NewSPIBus(embd.SPIMode0, byte(globalSettings.MCP3008SPIChannel), MCP3008_SPI_SPEED, 8, 0)
+		return &mcpSource{adc: newMCP3008(bus, globalSettings.MCP3008VrefMillivolts), channel: globalSettings.MCP3008Input}, nil
+	}
+}
+
+func (s *mcpSource) readSample() (inputSample, error) {
+	time.Sleep(SAMPLE_POLL_INTERVAL)
+	t := time.Now()
+	v, err := s.adc.read(s.channel, false)
+	return inputSample{Time: t, Millivolts: s.adc.millivolts(v)}, err
+}
+
+func (s *mcpSource) close() error {
+	return s.adc.close()
+}
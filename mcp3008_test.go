@@ -0,0 +1,141 @@
+/*
+	Copyright (c) 2016 Christopher Young
+	Distributable under the terms of The "BSD New"" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	mcp3008_test.go: MCP3008 driver against a simulated SPI bus.
+*/
+
+package main
+
+import (
+	"errors"
+	"sync"
+	"testing"
+)
+
+// In-memory SPI bus emulating an MCP3008.
+type fakeMCP3008Bus struct {
+	// Produces the 10-bit result for a channel. Differential reads get the channel number too.
+	convert  func(channel int, differential bool) uint16
+	sent     [][]uint8 // Command bytes of each transfer.
+	failNext int       // Fail this many upcoming transfers.
+	closed   bool
+	mu       *sync.Mutex
+}
+
+func newFakeMCP3008Bus(convert func(channel int, differential bool) uint16) *fakeMCP3008Bus {
+	return &fakeMCP3008Bus{convert: convert, mu: &sync.Mutex{}}
+}
+
+func (b *fakeMCP3008Bus) TransferAndReceiveData(buf []uint8) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return errors.New("fake spi: bus closed")
+	}
+	if b.failNext > 0 {
+		b.failNext--
+		return errors.New("fake spi: transfer failed")
+	}
+	b.sent = append(b.sent, append([]uint8(nil), buf...))
+	if len(buf) != 3 || buf[0] != 0x01 {
+		return errors.New("fake spi: not an MCP3008 command")
+	}
+	v := b.convert(int(buf[1]>>4)&0x07, buf[1]&0x80 == 0) & 0x3FF
+	// The bits of the second byte ahead of the null bit and B9 B8 are undefined on the wire.
+	buf[0] = 0xFF
+	buf[1] = 0xF8 | uint8(v>>8)
+	buf[2] = uint8(v)
+	return nil
+}
+
+func (b *fakeMCP3008Bus) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	return nil
+}
+
+func TestMCP3008Framing(t *testing.T) {
+	tests := []struct {
+		channel      int
+		differential bool
+		ctl          uint8 // SGL/DIFF, D2 D1 D0, then don't care.
+	}{
+		{0, false, 0x80},
+		{3, false, 0xB0},
+		{7, false, 0xF0},
+		{0, true, 0x00},
+		{1, true, 0x10},
+		{6, true, 0x60},
+	}
+	for _, tt := range tests {
+		bus := newFakeMCP3008Bus(func(int, bool) uint16 { return 0 })
+		d := newMCP3008(bus, 5000)
+		if _, err := d.read(tt.channel, tt.differential); err != nil {
+			t.Fatal(err)
+		}
+		want := []uint8{0x01, tt.ctl, 0x00}
+		if got := bus.sent[0]; len(got) != 3 || got[0] != want[0] || got[1] != want[1] || got[2] != want[2] {
+			t.Errorf("channel %d differential %v: sent % x, want % x", tt.channel, tt.differential, got, want)
+		}
+	}
+}
+
+func TestMCP3008Read(t *testing.T) {
+	bus := newFakeMCP3008Bus(func(channel int, differential bool) uint16 {
+		if differential {
+			return 0x155
+		}
+		return []uint16{0, 1, 0x100, 0x2AA, 0x3FF, 512, 1000, 7}[channel]
+	})
+	d := newMCP3008(bus, 5000)
+
+	for ch, want := range []uint16{0, 1, 0x100, 0x2AA, 0x3FF, 512, 1000, 7} {
+		v, err := d.read(ch, false)
+		if err != nil || v != want {
+			t.Errorf("channel %d: %d, %v, want %d", ch, v, err, want)
+		}
+	}
+	if v, err := d.read(2, true); err != nil || v != 0x155 {
+		t.Errorf("differential: %d, %v", v, err)
+	}
+	for _, ch := range []int{-1, MCP3008_CHANNELS} {
+		if _, err := d.read(ch, false); err == nil {
+			t.Errorf("channel %d accepted", ch)
+		}
+	}
+
+	tests := []struct {
+		code uint16
+		mv   float64
+	}{
+		{0, 0},
+		{512, 2500},
+		{1023, 1023 * 5000.0 / 1024},
+	}
+	for _, tt := range tests {
+		if mv := d.millivolts(tt.code); mv != tt.mv {
+			t.Errorf("millivolts(%d) = %g, want %g", tt.code, mv, tt.mv)
+		}
+	}
+
+	bus.failNext = 1
+	if _, err := d.read(0, false); err == nil {
+		t.Error("transfer error not returned")
+	}
+	if err := d.close(); err != nil || !bus.closed {
+		t.Errorf("close: %v", err)
+	}
+}
+
+func TestMCP3008Source(t *testing.T) {
+	bus := newFakeMCP3008Bus(func(channel int, differential bool) uint16 { return uint16(channel) * 100 })
+	s := &mcpSource{adc: newMCP3008(bus, 5000), channel: 4}
+	smp, err := s.readSample()
+	if err != nil || smp.Millivolts != 400*5000.0/1024 || smp.Time.IsZero() {
+		t.Errorf("readSample: %+v, %v", smp, err)
+	}
+}
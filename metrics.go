@@ -0,0 +1,97 @@
+/*
+	Copyright (c) 2016 Christopher Young
+	Distributable under the terms of The "BSD New"" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	metrics.go: Prometheus/OpenMetrics text exporter on /metrics.
+*/
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+type metricCounters struct {
+	adcSamples       uint64 // Total conversions read from the ADC.
+	i2cReadErrors    uint64
+	websocketClients int64
+	dbWrites         uint64
+	dbWriteErrors    uint64
+	dbWriteNanosSum  uint64 // Sum of DB write latencies, for the _sum/_count pair.
+	dbWriteNanosLast uint64
+	adcSampleRate    *rateCounter
+}
+
+var metrics = metricCounters{
+	adcSampleRate: newRateCounter(1*time.Second, 10),
+}
+
+func (m *metricCounters) sampleRead() {
+	atomic.AddUint64(&m.adcSamples, 1)
+	m.adcSampleRate.Incr(time.Now(), 1)
+}
+
+func (m *metricCounters) i2cError() {
+	atomic.AddUint64(&m.i2cReadErrors, 1)
+}
+
+func (m *metricCounters) websocketConnected(delta int64) {
+	atomic.AddInt64(&m.websocketClients, delta)
+}
+
+// Record one DB write and how long it took.
+func (m *metricCounters) dbWrite(d time.Duration, err error) {
+	atomic.AddUint64(&m.dbWrites, 1)
+	atomic.AddUint64(&m.dbWriteNanosSum, uint64(d.Nanoseconds()))
+	atomic.StoreUint64(&m.dbWriteNanosLast, uint64(d.Nanoseconds()))
+	if err != nil {
+		atomic.AddUint64(&m.dbWriteErrors, 1)
+	}
+}
+
+func writeMetric(buf *bytes.Buffer, name, typ, help string, val float64) {
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s %s\n%s %g\n", name, help, name, typ, name, val)
+}
+
+// GET /metrics.
+func handleMetrics(w http.ResponseWriter, req *http.Request) {
+	s := currentStats()
+	totalRaw := s.flow_total_raw
+	total := s.Flow_Total
+	secondGPH := s.Flow_LastSecond_GPH
+	minuteGPH := s.Flow_LastMinute_GPH
+	hourGPH := s.Flow_LastHour_Actual_GPH
+	remaining := s.Fuel_Remaining
+	signalScore := s.Signal_Quality.Score
+
+	var buf bytes.Buffer
+	writeMetric(&buf, "flowfast_pulses_total", "counter", "Flow transducer pulses counted since start.", float64(totalRaw))
+	writeMetric(&buf, "flowfast_fuel_used_gallons", "gauge", "Fuel used since start.", total)
+	writeMetric(&buf, "flowfast_fuel_remaining_gallons", "gauge", "Totalizer fuel remaining.", remaining)
+	writeMetric(&buf, "flowfast_flow_last_second_gph", "gauge", "Flow over the last second, extrapolated to GPH.", secondGPH)
+	writeMetric(&buf, "flowfast_flow_last_minute_gph", "gauge", "Flow over the last minute, extrapolated to GPH.", minuteGPH)
+	writeMetric(&buf, "flowfast_flow_last_hour_gph", "gauge", "Actual flow over the last hour.", hourGPH)
+	writeMetric(&buf, "flowfast_adc_samples_total", "counter", "ADC conversions read.", float64(atomic.LoadUint64(&metrics.adcSamples)))
+	writeMetric(&buf, "flowfast_adc_sample_rate_hz", "gauge", "ADC conversions read over the last second.", float64(metrics.adcSampleRate.Rate(time.Now())))
+	writeMetric(&buf, "flowfast_signal_quality_score", "gauge", "Input signal quality, 0-100. -1 until measured.", signalScore)
+	writeMetric(&buf, "flowfast_i2c_read_errors_total", "counter", "I2C read errors.", float64(atomic.LoadUint64(&metrics.i2cReadErrors)))
+	writeMetric(&buf, "flowfast_input_queue_depth", "gauge", "Samples waiting in inputChan.", float64(len(inputChan)))
+	writeMetric(&buf, "flowfast_log_queue_depth", "gauge", "Rows waiting in logChan.", float64(len(logChan)))
+	writeMetric(&buf, "flowfast_websocket_clients", "gauge", "Connected websocket clients.", float64(atomic.LoadInt64(&metrics.websocketClients)))
+	writeMetric(&buf, "flowfast_db_write_errors_total", "counter", "Failed DB writes.", float64(atomic.LoadUint64(&metrics.dbWriteErrors)))
+	writeMetric(&buf, "flowfast_db_write_last_seconds", "gauge", "Latency of the most recent DB write.", float64(atomic.LoadUint64(&metrics.dbWriteNanosLast))/1e9)
+
+	// Summary without quantiles.
+	fmt.Fprintf(&buf, "# HELP flowfast_db_write_seconds DB write latency.\n# TYPE flowfast_db_write_seconds summary\n")
+	fmt.Fprintf(&buf, "flowfast_db_write_seconds_sum %g\n", float64(atomic.LoadUint64(&metrics.dbWriteNanosSum))/1e9)
+	fmt.Fprintf(&buf, "flowfast_db_write_seconds_count %d\n", atomic.LoadUint64(&metrics.dbWrites))
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(buf.Bytes())
+}
@@ -0,0 +1,111 @@
+/*
+	Copyright (c) 2016 Christopher Young
+	Distributable under the terms of The "BSD New"" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	metrics_test.go: /metrics Prometheus text output.
+*/
+
+package main
+
+import (
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Parse the text exposition format: sample values by name, and the TYPE of each metric family.
+func parseMetrics(t *testing.T, body string) (map[string]float64, map[string]string) {
+	values := make(map[string]float64)
+	types := make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSpace(body), "\n") {
+		f := strings.Fields(line)
+		switch {
+		case strings.HasPrefix(line, "# TYPE "):
+			if len(f) != 4 {
+				t.Fatalf("bad TYPE line %q", line)
+			}
+			types[f[2]] = f[3]
+		case strings.HasPrefix(line, "# HELP "):
+			if len(f) < 4 {
+				t.Fatalf("HELP without text %q", line)
+			}
+		default:
+			if len(f) != 2 {
+				t.Fatalf("bad sample line %q", line)
+			}
+			v, err := strconv.ParseFloat(f[1], 64)
+			if err != nil {
+				t.Fatalf("bad value in %q", line)
+			}
+			if _, dup := values[f[0]]; dup {
+				t.Errorf("%s repeated", f[0])
+			}
+			values[f[0]] = v
+		}
+	}
+	return values, types
+}
+
+func TestHandleMetrics(t *testing.T) {
+	saved := flowSnapshot.Load()
+	defer func() {
+		if saved != nil {
+			flowSnapshot.Store(saved)
+		}
+	}()
+	flowSnapshot.Store(&FlowStats{
+		flow_total_raw:      6800,
+		Flow_Total:          0.1,
+		Flow_LastMinute_GPH: 8.5,
+		Fuel_Remaining:      39.9,
+		Signal_Quality:      signalQualityStatus{Score: 97},
+	})
+	metrics.dbWrite(20*time.Millisecond, nil)
+
+	rec := httptest.NewRecorder()
+	handleMetrics(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type %q", ct)
+	}
+	values, types := parseMetrics(t, rec.Body.String())
+
+	for name, want := range map[string]float64{
+		"flowfast_pulses_total":           6800,
+		"flowfast_fuel_used_gallons":      0.1,
+		"flowfast_flow_last_minute_gph":   8.5,
+		"flowfast_fuel_remaining_gallons": 39.9,
+		"flowfast_signal_quality_score":   97,
+		"flowfast_input_queue_depth":      float64(len(inputChan)),
+	} {
+		if v, ok := values[name]; !ok || v != want {
+			t.Errorf("%s = %g (present %v), want %g", name, v, ok, want)
+		}
+	}
+	for name, typ := range map[string]string{
+		"flowfast_pulses_total":          "counter",
+		"flowfast_adc_samples_total":     "counter",
+		"flowfast_i2c_read_errors_total": "counter",
+		"flowfast_input_queue_depth":     "gauge",
+		"flowfast_log_queue_depth":       "gauge",
+		"flowfast_websocket_clients":     "gauge",
+		"flowfast_db_write_seconds":      "summary",
+	} {
+		if types[name] != typ {
+			t.Errorf("%s TYPE %q, want %s", name, types[name], typ)
+		}
+	}
+	if values["flowfast_db_write_seconds_count"] < 1 || values["flowfast_db_write_seconds_sum"] < 0.02 {
+		t.Errorf("db write summary: count %g, sum %g", values["flowfast_db_write_seconds_count"], values["flowfast_db_write_seconds_sum"])
+	}
+	// Every sample belongs to a declared family.
+	for name := range values {
+		family := strings.TrimSuffix(strings.TrimSuffix(name, "_sum"), "_count")
+		if types[name] == "" && types[family] == "" {
+			t.Errorf("%s has no TYPE", name)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+/*
+	Copyright (c) 2016 Christopher Young
+	Distributable under the terms of The "BSD New"" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	migrations.go: Versioned schema migrations for the SQLite database.
+		Migrations are embedded from migrations/NNNN_name.sql and applied in order, each in its
+		own transaction. The schema version is kept in PRAGMA user_version.
+*/
+
+package main
+
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+type dbMigration struct {
+	version int
+	name    string
+	sql     string
+}
+
+// Embedded migrations, sorted by version.
+func loadMigrations() ([]dbMigration, error) {
+	entries, err := migrationFiles.ReadDir("migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]dbMigration, 0, len(entries))
+	for _, e := range entries {
+		name := e.Name()
+		i := strings.IndexByte(name, '_')
+		if i <= 0 || !strings.HasSuffix(name, ".sql") {
+			return nil, fmt.Errorf("bad migration file name '%s'", name)
+		}
+		version, err := strconv.Atoi(name[:i])
+		if err != nil {
+			return nil, fmt.Errorf("bad migration file name '%s'", name)
+		}
+		buf, err := migrationFiles.ReadFile(path.Join("migrations", name))
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, dbMigration{version: version, name: name, sql: string(buf)})
+	}
+
+	sort.Slice(ret, func(i, j int) bool { return ret[i].version < ret[j].version })
+	for i, m := range ret {
+		if m.version != i+1 {
+			return nil, fmt.Errorf("migration '%s' out of sequence, expected version %d", m.name, i+1)
+		}
+	}
+	return ret, nil
+}
+
+func schemaVersion(db *sql.DB) (int, error) {
+	var v int
+	err := db.QueryRow("PRAGMA user_version").Scan(&v)
+	return v, err
+}
+
+// Bring the database schema up to the latest version.
+func migrateDB(db *sql.DB) error {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+
+	cur, err := schemaVersion(db)
+	if err != nil {
+		return err
+	}
+	if cur > len(migrations) {
+		return fmt.Errorf("database schema version %d is newer than this build (%d)", cur, len(migrations))
+	}
+
+	for _, m := range migrations[cur:] {
+		logger.Debugf("applying migration '%s'.\n", m.name)
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(m.sql); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration '%s': %s", m.name, err.Error())
+		}
+		// user_version is transactional, so the schema change and the version bump land together.
+		if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", m.version)); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
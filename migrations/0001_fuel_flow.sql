@@ -0,0 +1,2 @@
+-- Original schema. IF NOT EXISTS so that databases created before versioning are adopted as-is.
+CREATE TABLE IF NOT EXISTS fuel_flow (id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT, log_date_start INTEGER, log_date_end INTEGER, flow REAL);
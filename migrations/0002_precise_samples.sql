@@ -0,0 +1,16 @@
+-- Nanosecond interval bounds, raw pulse count and the K-factor in effect, so totals can be
+-- recomputed exactly after a calibration change. log_date_start/log_date_end (unix seconds) stay
+-- for older readers.
+ALTER TABLE fuel_flow ADD COLUMN log_start_ns INTEGER;
+ALTER TABLE fuel_flow ADD COLUMN log_end_ns INTEGER;
+ALTER TABLE fuel_flow ADD COLUMN pulses INTEGER;
+ALTER TABLE fuel_flow ADD COLUMN k_factor REAL;
+
+-- Older rows were all logged with the fixed FT-60 K-factor.
+UPDATE fuel_flow SET
+	log_start_ns = log_date_start * 1000000000,
+	log_end_ns = log_date_end * 1000000000,
+	pulses = CAST(ROUND(flow * 68000.0) AS INTEGER),
+	k_factor = 68000.0;
+
+CREATE INDEX IF NOT EXISTS fuel_flow_log_date_start ON fuel_flow(log_date_start);
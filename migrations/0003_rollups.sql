@@ -0,0 +1,7 @@
+-- Rollups of fuel_flow. Times are the start of the bucket, unix seconds.
+CREATE TABLE IF NOT EXISTS fuel_flow_minute (minute INTEGER NOT NULL PRIMARY KEY, pulses INTEGER, flow REAL, samples INTEGER);
+CREATE TABLE IF NOT EXISTS fuel_flow_hour (hour INTEGER NOT NULL PRIMARY KEY, pulses INTEGER, flow REAL, samples INTEGER);
+
+-- One row per flight / engine run.
+CREATE TABLE IF NOT EXISTS sessions (id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT, start_ns INTEGER, end_ns INTEGER, pulses INTEGER, fuel_used REAL, avg_gph REAL, max_gph REAL);
+CREATE INDEX IF NOT EXISTS sessions_start_ns ON sessions(start_ns);
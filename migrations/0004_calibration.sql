@@ -0,0 +1,2 @@
+-- K-factor history. Each fuel_flow row also carries the K-factor it was logged with.
+CREATE TABLE IF NOT EXISTS calibration (id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT, time_ns INTEGER, k_factor REAL, note TEXT);
@@ -0,0 +1,2 @@
+-- Range queries (export, rollups, journal replay) go by log_start_ns since 0002.
+CREATE INDEX IF NOT EXISTS fuel_flow_log_start_ns ON fuel_flow(log_start_ns);
@@ -0,0 +1,234 @@
+//go:build cgo
+// +build cgo
+
+/*
+	Copyright (c) 2016 Christopher Young
+	Distributable under the terms of The "BSD New"" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	migrations_test.go: Schema migrations from an unversioned database and from part way.
+*/
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func openTestDB(t *testing.T) *sql.DB {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "flowfast.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func tableColumns(t *testing.T, db *sql.DB, table string) map[string]bool {
+	rows, err := db.Query("PRAGMA table_info(" + table + ")")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	ret := make(map[string]bool)
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, typ string
+		var dflt sql.NullString
+		if err := rows.Scan(&cid, &name, &typ, &notNull, &dflt, &pk); err != nil {
+			t.Fatal(err)
+		}
+		ret[name] = true
+	}
+	return ret
+}
+
+func schemaObjects(t *testing.T, db *sql.DB, typ string) map[string]bool {
+	rows, err := db.Query("SELECT name FROM sqlite_master WHERE type = ?", typ)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	ret := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			t.Fatal(err)
+		}
+		ret[name] = true
+	}
+	return ret
+}
+
+func checkLatestSchema(t *testing.T, db *sql.DB) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := schemaVersion(db); err != nil || v != len(migrations) {
+		t.Errorf("user_version %d, want %d (%v)", v, len(migrations), err)
+	}
+	cols := tableColumns(t, db, "fuel_flow")
+	for _, c := range []string{"id", "log_date_start", "log_date_end", "flow", "log_start_ns", "log_end_ns", "pulses", "k_factor"} {
+		if !cols[c] {
+			t.Errorf("fuel_flow has no column %s", c)
+		}
+	}
+	tables := schemaObjects(t, db, "table")
+	for _, name := range []string{"fuel_flow_minute", "fuel_flow_hour", "sessions", "calibration"} {
+		if !tables[name] {
+			t.Errorf("no table %s", name)
+		}
+	}
+	indexes := schemaObjects(t, db, "index")
+	for _, name := range []string{"fuel_flow_log_date_start", "fuel_flow_log_start_ns", "sessions_start_ns"} {
+		if !indexes[name] {
+			t.Errorf("no index %s", name)
+		}
+	}
+}
+
+// A database from before versioning: the original table, user_version 0, rows in seconds and gallons.
+func TestMigrateUnversioned(t *testing.T) {
+	db := openTestDB(t)
+	if _, err := db.Exec("CREATE TABLE fuel_flow (id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT, log_date_start INTEGER, log_date_end INTEGER, flow REAL)"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("INSERT INTO fuel_flow (log_date_start, log_date_end, flow) VALUES (1460000000, 1460000001, 0.5), (1460000001, 1460000002, 0.00001)"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := migrateDB(db); err != nil {
+		t.Fatal(err)
+	}
+	checkLatestSchema(t, db)
+
+	rows, err := db.Query("SELECT log_date_start, log_start_ns, log_end_ns, pulses, k_factor FROM fuel_flow ORDER BY id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	want := []struct {
+		start, startNs, endNs, pulses int64
+	}{
+		{1460000000, 1460000000000000000, 1460000001000000000, 34000},
+		{1460000001, 1460000001000000000, 1460000002000000000, 1}, // 0.68 pulses, rounded.
+	}
+	i := 0
+	for ; rows.Next(); i++ {
+		var start, startNs, endNs, pulses int64
+		var k float64
+		if err := rows.Scan(&start, &startNs, &endNs, &pulses, &k); err != nil {
+			t.Fatal(err)
+		}
+		if i >= len(want) {
+			break
+		}
+		w := want[i]
+		if start != w.start || startNs != w.startNs || endNs != w.endNs || pulses != w.pulses || k != 68000 {
+			t.Errorf("row %d backfilled as %d %d %d %d %g", i, start, startNs, endNs, pulses, k)
+		}
+	}
+	if i != len(want) {
+		t.Errorf("%d rows after migration, want %d", i, len(want))
+	}
+}
+
+// Each migration bumps user_version with it, so a database part way up only gets the rest.
+func TestMigrateSteps(t *testing.T) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, m := range migrations {
+		if m.version != i+1 {
+			t.Fatalf("migration %s has version %d, want %d", m.name, m.version, i+1)
+		}
+	}
+
+	for from := 0; from <= len(migrations); from++ {
+		db := openTestDB(t)
+		for _, m := range migrations[:from] {
+			if _, err := db.Exec(m.sql); err != nil {
+				t.Fatalf("%s: %s", m.name, err.Error())
+			}
+		}
+		if _, err := db.Exec(fmt.Sprintf("PRAGMA user_version = %d", from)); err != nil {
+			t.Fatal(err)
+		}
+		// Re-running an applied ALTER TABLE would fail on the duplicate column.
+		if err := migrateDB(db); err != nil {
+			t.Errorf("from version %d: %s", from, err.Error())
+			continue
+		}
+		checkLatestSchema(t, db)
+		if err := migrateDB(db); err != nil {
+			t.Errorf("from version %d, second run: %s", from, err.Error())
+		}
+	}
+}
+
+// A failed migration rolls back with its version bump, leaving user_version at the last one applied.
+func TestMigrateStopsOnFailure(t *testing.T) {
+	db := openTestDB(t)
+	// 0002 adds log_start_ns, which this table already has.
+	if _, err := db.Exec("CREATE TABLE fuel_flow (id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT, log_date_start INTEGER, log_date_end INTEGER, flow REAL, log_start_ns INTEGER)"); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrateDB(db); err == nil {
+		t.Fatal("conflicting migration succeeded")
+	}
+	if v, _ := schemaVersion(db); v != 1 {
+		t.Errorf("user_version %d after 0002 failed, want 1", v)
+	}
+	if cols := tableColumns(t, db, "fuel_flow"); cols["pulses"] {
+		t.Error("0002 partly applied")
+	}
+}
+
+func TestMigrateNewerRefused(t *testing.T) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := openTestDB(t)
+	if _, err := db.Exec("PRAGMA user_version = 99"); err != nil {
+		t.Fatal(err)
+	}
+	if len(migrations) < 99 && migrateDB(db) == nil {
+		t.Error("database from a newer build migrated")
+	}
+	if v, _ := schemaVersion(db); v != 99 {
+		t.Errorf("user_version changed to %d", v)
+	}
+}
+
+// Sample range queries go through the log_start_ns index, not a table scan.
+func TestSampleQueryUsesIndex(t *testing.T) {
+	db := openTestDB(t)
+	if err := migrateDB(db); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := db.Query("EXPLAIN QUERY PLAN SELECT log_start_ns, log_end_ns, pulses, k_factor, flow FROM fuel_flow WHERE log_start_ns >= ? AND log_start_ns < ? ORDER BY log_start_ns", 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	plan := ""
+	for rows.Next() {
+		var id, parent, notused int
+		var detail string
+		if err := rows.Scan(&id, &parent, &notused, &detail); err != nil {
+			t.Fatal(err)
+		}
+		plan += detail + "\n"
+	}
+	if !strings.Contains(plan, "fuel_flow_log_start_ns") {
+		t.Errorf("query plan doesn't use the index:\n%s", plan)
+	}
+}
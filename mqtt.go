@@ -0,0 +1,293 @@
+/*
+	Copyright (c) 2016 Christopher Young
+	Distributable under the terms of The "BSD New"" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	mqtt.go: Optional MQTT publisher for stats snapshots, alerts and session summaries.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/eclipse/paho.mqtt.golang"
+	"io/ioutil"
+	"sync"
+	"time"
+)
+
+const (
+	MQTT_PUBLISH_TIMEOUT = 5 * time.Second
+	MQTT_CONNECT_RETRY   = 10 * time.Second
+
+	MQTT_DISCONNECT_QUIESCE = 250             // units=ms. Time for in-flight publishes on shutdown.
+	MQTT_SHUTDOWN_FLUSH     = 5 * time.Second // Publishing what's queued on shutdown, well inside SHUTDOWN_TIMEOUT.
+)
+
+type mqttMessage struct {
+	topic   string
+	payload []byte
+	retain  bool
+}
+
+// Messages held while the broker is unreachable. Alerts and sessions are queued (oldest dropped
+// first when full), only the most recent stats snapshot is kept.
+type mqttBuffer struct {
+	queue     []mqttMessage
+	lastStats *mqttMessage
+	mu        *sync.Mutex
+}
+
+func (b *mqttBuffer) add(m mqttMessage, isStats bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if isStats {
+		b.lastStats = &m
+		return
+	}
+	b.queue = append(b.queue, m)
+	if len(b.queue) > globalSettings.MQTTBufferLen {
+		b.queue = b.queue[len(b.queue)-globalSettings.MQTTBufferLen:]
+	}
+}
+
+func (b *mqttBuffer) take() []mqttMessage {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ret := b.queue
+	if b.lastStats != nil {
+		ret = append(ret, *b.lastStats)
+	}
+	b.queue = nil
+	b.lastStats = nil
+	return ret
+}
+
+// Put back messages taken but not sent, ahead of anything added since.
+func (b *mqttBuffer) requeue(ms []mqttMessage) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.queue = append(append([]mqttMessage(nil), ms...), b.queue...)
+	if len(b.queue) > globalSettings.MQTTBufferLen {
+		b.queue = b.queue[len(b.queue)-globalSettings.MQTTBufferLen:]
+	}
+}
+
+func mqttTopic(suffix string) string {
+	return globalSettings.MQTTTopicPrefix + "/" + suffix
+}
+
+func mqttTLSConfig() (*tls.Config, error) {
+	cfg := &tls.Config{InsecureSkipVerify: globalSettings.MQTTTLSInsecure}
+	if len(globalSettings.MQTTCACert) > 0 {
+		pem, err := ioutil.ReadFile(globalSettings.MQTTCACert)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in '%s'", globalSettings.MQTTCACert)
+		}
+		cfg.RootCAs = pool
+	}
+	if len(globalSettings.MQTTClientCert) > 0 {
+		cert, err := tls.LoadX509KeyPair(globalSettings.MQTTClientCert, globalSettings.MQTTClientKey)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+func mqttPublish(client mqtt.Client, m mqttMessage) error {
+	return mqttPublishWithin(client, m, MQTT_PUBLISH_TIMEOUT)
+}
+
+func mqttPublishWithin(client mqtt.Client, m mqttMessage, timeout time.Duration) error {
+	token := client.Publish(m.topic, globalSettings.MQTTQoS, m.retain, m.payload)
+	if !token.WaitTimeout(timeout) {
+		return fmt.Errorf("publish to '%s' timed out", m.topic)
+	}
+	return token.Error()
+}
+
+// Message for an event from the hub. ok is false for events that aren't published.
+func mqttMessageFor(e streamEvent) (m mqttMessage, isStats, ok bool) {
+	switch e.Type {
+	case EVENT_TYPE_STATS:
+		return mqttMessage{topic: mqttTopic("stats"), payload: e.Data, retain: globalSettings.MQTTRetain}, true, true
+	case EVENT_TYPE_ALERT:
+		return mqttMessage{topic: mqttTopic("alert"), payload: e.Data, retain: globalSettings.MQTTRetain}, false, true
+	case EVENT_TYPE_SESSION:
+		return mqttMessage{topic: mqttTopic("session"), payload: e.Data, retain: globalSettings.MQTTRetain}, false, true
+	}
+	return mqttMessage{}, false, false
+}
+
+// Publishes events from the hub to MQTTBroker. Runs only if MQTTBroker is set. When ctx is
+// cancelled, publishes what's still queued (for up to MQTT_SHUTDOWN_FLUSH), marks the status topic
+// offline and disconnects.
+func mqttPublisher(ctx context.Context) {
+	buf := mqttBuffer{mu: &sync.Mutex{}}
+	statusTopic := mqttTopic("status")
+
+	opts := mqtt.NewClientOptions()
+	opts.AddBroker(globalSettings.MQTTBroker)
+	opts.SetClientID(globalSettings.MQTTClientID)
+	opts.SetUsername(globalSettings.MQTTUsername)
+	opts.SetPassword(globalSettings.MQTTPassword)
+	opts.SetAutoReconnect(true)
+	opts.SetWill(statusTopic, "offline", globalSettings.MQTTQoS, true)
+	if globalSettings.MQTTTLS {
+		cfg, err := mqttTLSConfig()
+		if err != nil {
+			logger.Errorf("MQTT TLS setup: %s\n", err.Error())
+			return
+		}
+		opts.SetTLSConfig(cfg)
+	}
+	connected := make(chan struct{}, 1)
+	opts.SetOnConnectHandler(func(c mqtt.Client) {
+		logger.Debugf("connected to MQTT broker '%s'.\n", globalSettings.MQTTBroker)
+		mqttPublish(c, mqttMessage{topic: statusTopic, payload: []byte("online"), retain: true})
+		// What was held while offline goes out from the main loop, ahead of anything new.
+		select {
+		case connected <- struct{}{}:
+		default:
+		}
+	})
+	opts.SetConnectionLostHandler(func(c mqtt.Client, err error) {
+		logger.Errorf("lost MQTT connection: %s\n", err.Error())
+	})
+
+	// Subscribe before connecting so nothing is missed while the first connection is retried.
+	ch, _ := events.subscribe(0)
+	defer func() { events.unsubscribe(ch) }()
+	lastID := uint64(0)
+	var resumed []streamEvent // Retained events to catch up on after falling behind.
+
+	client := mqtt.NewClient(opts)
+	go func() {
+		// The client only reconnects on its own after a first successful connection.
+		for {
+			token := client.Connect()
+			token.Wait()
+			if token.Error() == nil {
+				return
+			}
+			logger.Errorf("MQTT connect to '%s': %s\n", globalSettings.MQTTBroker, token.Error().Error())
+			select {
+			case <-time.After(MQTT_CONNECT_RETRY):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	// Send what was held while offline, in order. Stops at the first failure and keeps the rest.
+	drain := func() bool {
+		pending := buf.take()
+		for i, m := range pending {
+			if err := mqttPublish(client, m); err != nil {
+				logger.Errorf("MQTT publish: %s\n", err.Error())
+				buf.requeue(pending[i:])
+				return false
+			}
+		}
+		return true
+	}
+
+	// On shutdown: everything still in ch goes into the buffer behind what's held already, then the
+	// buffer is sent while there's time.
+	flush := func() {
+		for n := len(ch); n > 0; n-- {
+			resumed = append(resumed, <-ch)
+		}
+		for _, e := range resumed {
+			if m, isStats, ok := mqttMessageFor(e); ok {
+				buf.add(m, isStats)
+			}
+		}
+		pending := buf.take()
+		if !client.IsConnectionOpen() {
+			if len(pending) > 0 {
+				logger.Errorf("MQTT not connected, dropping %d messages.\n", len(pending))
+			}
+			return
+		}
+		deadline := time.Now().Add(MQTT_SHUTDOWN_FLUSH)
+		for i, m := range pending {
+			left := time.Until(deadline)
+			if left <= 0 {
+				logger.Errorf("MQTT shutdown flush timed out, dropping %d messages.\n", len(pending)-i)
+				return
+			}
+			if left > MQTT_PUBLISH_TIMEOUT {
+				left = MQTT_PUBLISH_TIMEOUT
+			}
+			if err := mqttPublishWithin(client, m, left); err != nil {
+				logger.Errorf("MQTT publish: %s\n", err.Error())
+			}
+		}
+	}
+
+	lastStats := time.Time{}
+	for {
+		var e streamEvent
+		if len(resumed) > 0 {
+			e, resumed = resumed[0], resumed[1:]
+		} else {
+			select {
+			case ev, ok := <-ch:
+				if !ok {
+					// Fell behind the hub. Pick up the retained events missed since lastID.
+					ch, resumed = events.subscribe(lastID)
+					logger.Errorf("MQTT publisher fell behind, resuming with %d events.\n", len(resumed))
+					continue
+				}
+				e = ev
+			case <-connected:
+				if client.IsConnectionOpen() {
+					drain()
+				}
+				continue
+			case <-ctx.Done():
+				flush()
+				if client.IsConnectionOpen() {
+					mqttPublish(client, mqttMessage{topic: statusTopic, payload: []byte("offline"), retain: true})
+				}
+				client.Disconnect(MQTT_DISCONNECT_QUIESCE)
+				return
+			}
+		}
+		lastID = e.ID
+
+		m, isStats, ok := mqttMessageFor(e)
+		if !ok {
+			continue
+		}
+		if isStats {
+			if time.Since(lastStats) < time.Duration(globalSettings.MQTTStatsInterval)*time.Second {
+				continue
+			}
+			lastStats = time.Now()
+		}
+
+		if !client.IsConnectionOpen() || !drain() {
+			buf.add(m, isStats)
+			continue
+		}
+		if err := mqttPublish(client, m); err != nil {
+			logger.Errorf("MQTT publish: %s\n", err.Error())
+			buf.add(m, isStats)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+/*
+	Copyright (c) 2016 Christopher Young
+	Distributable under the terms of The "BSD New"" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	mqtt_test.go: Offline buffer and message mapping, without a broker.
+*/
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestMQTTBuffer(t *testing.T) {
+	saved := globalSettings
+	defer func() { globalSettings = saved }()
+	globalSettings.MQTTBufferLen = 3
+
+	b := mqttBuffer{mu: &sync.Mutex{}}
+	for i := 0; i < 5; i++ {
+		b.add(mqttMessage{topic: "flowfast/alert", payload: []byte(fmt.Sprint(i))}, false)
+		b.add(mqttMessage{topic: "flowfast/stats", payload: []byte(fmt.Sprint(i))}, true)
+	}
+	// Oldest alerts trimmed, one stats snapshot (the latest) sent last.
+	got := b.take()
+	want := []string{"flowfast/alert 2", "flowfast/alert 3", "flowfast/alert 4", "flowfast/stats 4"}
+	if len(got) != len(want) {
+		t.Fatalf("take() = %d messages, want %d", len(got), len(want))
+	}
+	for i, m := range got {
+		if s := m.topic + " " + string(m.payload); s != want[i] {
+			t.Errorf("message %d: %s, want %s", i, s, want[i])
+		}
+	}
+	if got := b.take(); len(got) != 0 {
+		t.Errorf("second take() = %d messages", len(got))
+	}
+
+	// Unsent messages go back ahead of newer ones, the oldest trimmed.
+	b.add(mqttMessage{topic: "flowfast/session", payload: []byte("5")}, false)
+	b.requeue(got[1:])
+	got = b.take()
+	want = []string{"flowfast/alert 4", "flowfast/stats 4", "flowfast/session 5"}
+	if len(got) != len(want) {
+		t.Fatalf("after requeue() take() = %d messages, want %d", len(got), len(want))
+	}
+	for i, m := range got {
+		if s := m.topic + " " + string(m.payload); s != want[i] {
+			t.Errorf("after requeue() message %d: %s, want %s", i, s, want[i])
+		}
+	}
+
+	// No queue at all: alerts are dropped, stats still coalesce.
+	globalSettings.MQTTBufferLen = 0
+	b.add(mqttMessage{topic: "flowfast/session"}, false)
+	b.add(mqttMessage{topic: "flowfast/stats"}, true)
+	if got := b.take(); len(got) != 1 || got[0].topic != "flowfast/stats" {
+		t.Errorf("MQTTBufferLen 0: take() = %+v", got)
+	}
+}
+
+func TestMQTTMessageFor(t *testing.T) {
+	saved := globalSettings
+	defer func() { globalSettings = saved }()
+	globalSettings.MQTTTopicPrefix = "aircraft/N12345"
+
+	for _, retain := range []bool{true, false} {
+		globalSettings.MQTTRetain = retain
+		tests := []struct {
+			typ     string
+			topic   string
+			isStats bool
+		}{
+			{EVENT_TYPE_STATS, "aircraft/N12345/stats", true},
+			{EVENT_TYPE_ALERT, "aircraft/N12345/alert", false},
+			{EVENT_TYPE_SESSION, "aircraft/N12345/session", false},
+		}
+		for _, tt := range tests {
+			m, isStats, ok := mqttMessageFor(streamEvent{ID: 7, Type: tt.typ, Data: []byte(`{}`)})
+			if !ok || m.topic != tt.topic || isStats != tt.isStats || m.retain != retain || string(m.payload) != `{}` {
+				t.Errorf("%s, retain %v: %+v, stats %v, ok %v", tt.typ, retain, m, isStats, ok)
+			}
+		}
+	}
+	if _, _, ok := mqttMessageFor(streamEvent{Type: "keepalive"}); ok {
+		t.Error("unknown event type published")
+	}
+}
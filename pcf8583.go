@@ -0,0 +1,184 @@
+/*
+	Copyright (c) 2016 Christopher Young
+	Distributable under the terms of The "BSD New"" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	pcf8583.go: PCF8583 in event counter mode, and the "pcf8583" flow input. The transducer
+		drives OSCI and the chip keeps a 6 digit BCD count, so no pulses are lost between polls.
+
+	Ref: https://www.nxp.com/docs/en/data-sheet/PCF8583.pdf
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+const (
+	PCF8583_ADDR_MIN = 0x50 // A0 to GND.
+	PCF8583_ADDR_MAX = 0x51 // A0 to VDD.
+
+	PCF8583_REG_CONTROL = 0x00
+	PCF8583_REG_COUNT   = 0x01 // Three BCD bytes, least significant first.
+
+	PCF8583_CONTROL_STOP  = 0x80 // Stop counting.
+	PCF8583_CONTROL_EVENT = 0x20 // Function mode: event counter.
+
+	PCF8583_COUNT_MOD  = 1000000 // Count wraps after 999999.
+	PCF8583_READ_TRIES = 3
+)
+
+// The part of embd.I2CBus the driver uses.
+type i2cByteBus interface {
+	ReadFromReg(addr, reg byte, value []byte) error
+	ReadByteFromReg(addr, reg byte) (byte, error)
+	WriteByteToReg(addr, reg, value byte) error
+	Close() error
+}
+
+type pcf8583 struct {
+	bus  i2cByteBus
+	addr byte
+	last uint32 // Count at the last readPulses().
+	mu   *sync.Mutex
+}
+
+func newPCF8583(bus i2cByteBus, addr byte) (*pcf8583, error) {
+	if addr < PCF8583_ADDR_MIN || addr > PCF8583_ADDR_MAX {
+		return nil, fmt.Errorf("invalid PCF8583 address 0x%02x", addr)
+	}
+	return &pcf8583{bus: bus, addr: addr, mu: &sync.Mutex{}}, nil
+}
+
+// Switch to event counter mode with the count at zero.
+func (d *pcf8583) init() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if err := d.bus.WriteByteToReg(d.addr, PCF8583_REG_CONTROL, PCF8583_CONTROL_STOP|PCF8583_CONTROL_EVENT); err != nil {
+		return fmt.Errorf("pcf8583 0x%02x: write control: %s", d.addr, err.Error())
+	}
+	for i := byte(0); i < 3; i++ {
+		if err := d.bus.WriteByteToReg(d.addr, PCF8583_REG_COUNT+i, 0); err != nil {
+			return fmt.Errorf("pcf8583 0x%02x: clear count: %s", d.addr, err.Error())
+		}
+	}
+	if err := d.bus.WriteByteToReg(d.addr, PCF8583_REG_CONTROL, PCF8583_CONTROL_EVENT); err != nil {
+		return fmt.Errorf("pcf8583 0x%02x: write control: %s", d.addr, err.Error())
+	}
+	c, err := d.bus.ReadByteFromReg(d.addr, PCF8583_REG_CONTROL)
+	if err != nil {
+		return fmt.Errorf("pcf8583 0x%02x: read control: %s", d.addr, err.Error())
+	}
+	if c&(PCF8583_CONTROL_STOP|0x30) != PCF8583_CONTROL_EVENT {
+		return fmt.Errorf("pcf8583 0x%02x: control read back 0x%02x, wrote 0x%02x", d.addr, c, PCF8583_CONTROL_EVENT)
+	}
+	d.last = 0
+	return nil
+}
+
+// Pick up after a re-init. The chip counts on its own, so if it's still in event counter mode the
+// count is kept and pulses since the last readPulses() are counted on the next one. Otherwise (power
+// cycled, or never set up) init().
+func (d *pcf8583) resume() error {
+	d.mu.Lock()
+	c, err := d.bus.ReadByteFromReg(d.addr, PCF8583_REG_CONTROL)
+	d.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("pcf8583 0x%02x: read control: %s", d.addr, err.Error())
+	}
+	if c&(PCF8583_CONTROL_STOP|0x30) == PCF8583_CONTROL_EVENT {
+		return nil
+	}
+	logger.Errorf("pcf8583 0x%02x: not counting (control 0x%02x), count lost.\n", d.addr, c)
+	return d.init()
+}
+
+func fromBCD(b byte) (uint32, error) {
+	if b>>4 > 9 || b&0x0F > 9 {
+		return 0, fmt.Errorf("invalid BCD byte 0x%02x", b)
+	}
+	return uint32(b>>4)*10 + uint32(b&0x0F), nil
+}
+
+func (d *pcf8583) readCount() (uint32, error) {
+	var buf [3]byte
+	if err := d.bus.ReadFromReg(d.addr, PCF8583_REG_COUNT, buf[:]); err != nil {
+		return 0, err
+	}
+	count := uint32(0)
+	for i := 2; i >= 0; i-- {
+		v, err := fromBCD(buf[i])
+		if err != nil {
+			return 0, fmt.Errorf("pcf8583 0x%02x: %s", d.addr, err.Error())
+		}
+		count = count*100 + v
+	}
+	return count, nil
+}
+
+// Current count. The chip keeps counting during the read, so a carry between bytes can tear it;
+// take two reads that agree.
+func (d *pcf8583) count() (uint32, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	prev, err := d.readCount()
+	if err != nil {
+		return 0, err
+	}
+	for i := 0; i < PCF8583_READ_TRIES; i++ {
+		c, err := d.readCount()
+		if err != nil {
+			return 0, err
+		}
+		if c == prev {
+			return c, nil
+		}
+		prev = c
+	}
+	return 0, fmt.Errorf("pcf8583 0x%02x: count not settling", d.addr)
+}
+
+// Pulses since the last call.
+func (d *pcf8583) readPulses() (uint64, error) {
+	c, err := d.count()
+	if err != nil {
+		return 0, err
+	}
+	n := (c + PCF8583_COUNT_MOD - d.last) % PCF8583_COUNT_MOD
+	d.last = c
+	return uint64(n), nil
+}
+
+func (d *pcf8583) close() error {
+	return d.bus.Close()
+}
+
+// Kept across re-inits so the count carries over.
+var pcf8583Input *pcf8583
+
+func init() {
+	inputSources["pcf8583"] = func(ctx context.Context) (flowInput, error) {
+		addr := byte(globalSettings.PCF8583Address)
+		if d := pcf8583Input; d != nil && d.addr == addr {
+			if err := d.resume(); err != nil {
+				return nil, err
+			}
+			return d, nil
+		}
+		d, err := newPCF8583(systemI2CBus(), addr)
+		if err != nil {
+			return nil, err
+		}
+		if err := d.init(); err != nil {
+			return nil, err
+		}
+		pcf8583Input = d
+		return d, nil
+	}
+}
@@ -0,0 +1,313 @@
+/*
+	Copyright (c) 2016 Christopher Young
+	Distributable under the terms of The "BSD New"" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	pcf8583_test.go: PCF8583 event counter driver against a simulated I2C bus.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// In-memory I2C bus emulating a PCF8583 in event counter mode. Call pulse() to count.
+type fakePCF8583Bus struct {
+	addr     byte
+	control  byte
+	count    uint32
+	raw      []byte // If set, returned by the next count read instead of count (bad BCD).
+	onRead   func() // Called before each count read, with the bus locked. For counts moving mid-read.
+	failNext int    // Fail this many upcoming transactions.
+	closed   bool
+	mu       *sync.Mutex
+}
+
+func newFakePCF8583Bus(addr byte) *fakePCF8583Bus {
+	return &fakePCF8583Bus{addr: addr, mu: &sync.Mutex{}}
+}
+
+func toBCD(v uint32) byte {
+	return byte(v/10)<<4 | byte(v%10)
+}
+
+// Count n events, if counting.
+func (b *fakePCF8583Bus) pulse(n uint32) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.countLocked(n)
+}
+
+func (b *fakePCF8583Bus) countLocked(n uint32) {
+	if b.control&PCF8583_CONTROL_STOP == 0 && b.control&0x30 == PCF8583_CONTROL_EVENT {
+		b.count = (b.count + n) % PCF8583_COUNT_MOD
+	}
+}
+
+func (b *fakePCF8583Bus) check(addr byte) error {
+	if b.closed {
+		return errors.New("fake i2c: bus closed")
+	}
+	if b.failNext > 0 {
+		b.failNext--
+		return errors.New("fake i2c: transaction failed")
+	}
+	if addr != b.addr {
+		return fmt.Errorf("fake i2c: no device at 0x%02x", addr)
+	}
+	return nil
+}
+
+func (b *fakePCF8583Bus) reg(reg byte) byte {
+	switch reg {
+	case PCF8583_REG_CONTROL:
+		return b.control
+	case PCF8583_REG_COUNT, PCF8583_REG_COUNT + 1, PCF8583_REG_COUNT + 2:
+		v := b.count
+		for i := byte(PCF8583_REG_COUNT); i < reg; i++ {
+			v /= 100
+		}
+		return toBCD(v % 100)
+	}
+	return 0
+}
+
+func (b *fakePCF8583Bus) ReadFromReg(addr, reg byte, value []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.check(addr); err != nil {
+		return err
+	}
+	if reg == PCF8583_REG_COUNT {
+		if b.onRead != nil {
+			b.onRead()
+		}
+		if b.raw != nil {
+			copy(value, b.raw)
+			b.raw = nil
+			return nil
+		}
+	}
+	for i := range value {
+		value[i] = b.reg(reg + byte(i))
+	}
+	return nil
+}
+
+func (b *fakePCF8583Bus) ReadByteFromReg(addr, reg byte) (byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.check(addr); err != nil {
+		return 0, err
+	}
+	return b.reg(reg), nil
+}
+
+func (b *fakePCF8583Bus) WriteByteToReg(addr, reg, value byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.check(addr); err != nil {
+		return err
+	}
+	switch reg {
+	case PCF8583_REG_CONTROL:
+		b.control = value
+	case PCF8583_REG_COUNT, PCF8583_REG_COUNT + 1, PCF8583_REG_COUNT + 2:
+		v, err := fromBCD(value)
+		if err != nil {
+			return err
+		}
+		digits := [3]uint32{b.count % 100, b.count / 100 % 100, b.count / 10000}
+		digits[reg-PCF8583_REG_COUNT] = v
+		b.count = digits[0] + digits[1]*100 + digits[2]*10000
+	}
+	return nil
+}
+
+func (b *fakePCF8583Bus) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	return nil
+}
+
+func newTestPCF8583(t *testing.T) (*pcf8583, *fakePCF8583Bus) {
+	bus := newFakePCF8583Bus(PCF8583_ADDR_MAX)
+	bus.count = 123456 // Left over from before init().
+	d, err := newPCF8583(bus, PCF8583_ADDR_MAX)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.init(); err != nil {
+		t.Fatal(err)
+	}
+	return d, bus
+}
+
+func TestFromBCD(t *testing.T) {
+	tests := []struct {
+		b    byte
+		want uint32
+		ok   bool
+	}{
+		{0x00, 0, true},
+		{0x09, 9, true},
+		{0x10, 10, true},
+		{0x42, 42, true},
+		{0x99, 99, true},
+		{0x0A, 0, false},
+		{0xA0, 0, false},
+		{0xFF, 0, false},
+	}
+	for _, tt := range tests {
+		got, err := fromBCD(tt.b)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("fromBCD(0x%02x) = %d, %v", tt.b, got, err)
+		}
+	}
+}
+
+func TestPCF8583Init(t *testing.T) {
+	d, bus := newTestPCF8583(t)
+	if bus.count != 0 || bus.control != PCF8583_CONTROL_EVENT {
+		t.Errorf("after init: count %d control 0x%02x", bus.count, bus.control)
+	}
+	if _, err := newPCF8583(bus, 0x52); err == nil {
+		t.Error("address 0x52 accepted")
+	}
+
+	bus.failNext = 1
+	if err := d.init(); err == nil {
+		t.Error("init ignored a bus error")
+	}
+}
+
+func TestPCF8583ReadPulses(t *testing.T) {
+	d, bus := newTestPCF8583(t)
+
+	bus.pulse(1234)
+	if n, err := d.readPulses(); n != 1234 || err != nil {
+		t.Errorf("readPulses() = %d, %v, want 1234", n, err)
+	}
+	if n, err := d.readPulses(); n != 0 || err != nil {
+		t.Errorf("no pulses: %d, %v", n, err)
+	}
+
+	// All three BCD bytes in use.
+	bus.pulse(987654 - 1234)
+	if n, _ := d.readPulses(); n != 987654-1234 {
+		t.Errorf("readPulses() = %d, want %d", n, 987654-1234)
+	}
+
+	// Wrap past 999999.
+	bus.pulse(999999 - 987654 + 26)
+	if bus.count != 25 {
+		t.Fatalf("fake count %d, want 25 after wrap", bus.count)
+	}
+	if n, _ := d.readPulses(); n != 999999-987654+26 {
+		t.Errorf("across the wrap: %d, want %d", n, 999999-987654+26)
+	}
+}
+
+func TestPCF8583TornRead(t *testing.T) {
+	d, bus := newTestPCF8583(t)
+	bus.pulse(99)
+
+	// Counting on during the first reads: the count settles once two reads agree.
+	moving := 2
+	bus.onRead = func() {
+		if moving > 0 {
+			moving--
+			bus.countLocked(1)
+		}
+	}
+	if n, err := d.readPulses(); n != 101 || err != nil {
+		t.Errorf("moving count: %d, %v, want 101", n, err)
+	}
+
+	// Never the same twice.
+	bus.onRead = func() { bus.countLocked(1) }
+	if _, err := d.readPulses(); err == nil {
+		t.Error("count that never settles accepted")
+	}
+	bus.onRead = nil
+
+	// A torn read can produce a digit that isn't BCD.
+	bus.raw = []byte{0x0A, 0x00, 0x00}
+	if _, err := d.readPulses(); err == nil {
+		t.Error("invalid BCD accepted")
+	}
+
+	// Nothing counted by the failed reads is lost.
+	before := d.last
+	if n, err := d.readPulses(); err != nil || uint32(n) != bus.count-before {
+		t.Errorf("after errors: %d, %v, want %d", n, err, bus.count-before)
+	}
+}
+
+// Pulses counted while the input was being re-initialized are read after it, not reset away.
+func TestPCF8583Resume(t *testing.T) {
+	d, bus := newTestPCF8583(t)
+	bus.pulse(100)
+	if n, _ := d.readPulses(); n != 100 {
+		t.Fatalf("readPulses() = %d, want 100", n)
+	}
+
+	bus.pulse(40) // Read errors, then re-init.
+	if err := d.resume(); err != nil {
+		t.Fatal(err)
+	}
+	bus.pulse(2)
+	if n, err := d.readPulses(); n != 42 || err != nil {
+		t.Errorf("after resume: %d, %v, want 42", n, err)
+	}
+
+	// Power cycled: the chip isn't counting, so it's set up again from zero.
+	bus.control = 0
+	bus.count = 0
+	if err := d.resume(); err != nil {
+		t.Fatal(err)
+	}
+	if bus.control != PCF8583_CONTROL_EVENT {
+		t.Errorf("control 0x%02x after resuming a reset chip", bus.control)
+	}
+	bus.pulse(7)
+	if n, _ := d.readPulses(); n != 7 {
+		t.Errorf("after re-init: %d, want 7", n)
+	}
+
+	bus.failNext = 1
+	if err := d.resume(); err == nil {
+		t.Error("resume ignored a bus error")
+	}
+}
+
+// Re-opening the input source after errors reuses the device and its count.
+func TestPCF8583SourceReopen(t *testing.T) {
+	savedSettings, savedInput := globalSettings, pcf8583Input
+	defer func() { globalSettings, pcf8583Input = savedSettings, savedInput }()
+
+	d, bus := newTestPCF8583(t)
+	globalSettings.PCF8583Address = int(d.addr)
+	pcf8583Input = d
+	bus.pulse(10)
+	d.readPulses()
+
+	bus.pulse(5) // Read errors, then re-open.
+	in, err := inputSources["pcf8583"](context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if in != flowInput(d) {
+		t.Fatal("re-open made a new device")
+	}
+	if n, _ := d.readPulses(); n != 5 {
+		t.Errorf("pulses across the re-open: %d, want 5", n)
+	}
+}
@@ -0,0 +1,88 @@
+/*
+	Copyright (c) 2016 Christopher Young
+	Distributable under the terms of The "BSD New"" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	period.go: Flow rate from the time between pulse edges. At low flow a one second count is only
+		a handful of pulses; the edge period resolves the rate far finer. Blended with the count
+		rate as flow goes up (Flow_Instant_GPH).
+*/
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	PERIOD_WINDOW  = 1 * time.Second // Edges averaged over.
+	PERIOD_TIMEOUT = 5 * time.Second // No edge for this long: no flow.
+
+	// units=pulses/sec. Period rate only below PERIOD_BLEND_LOW, count rate only above PERIOD_BLEND_HIGH.
+	PERIOD_BLEND_LOW  = 10.0
+	PERIOD_BLEND_HIGH = 100.0
+)
+
+type periodMeter struct {
+	edges      []time.Time // Within PERIOD_WINDOW of the latest.
+	lastPeriod time.Duration
+	seen       bool // Any edges at all. Counter chip inputs don't produce them.
+	mu         *sync.Mutex
+}
+
+var flowPeriod = periodMeter{mu: &sync.Mutex{}}
+
+// A rising edge in the sample taken at t. Capture time, not receive time: samples that queue up and
+// are processed in a burst keep their spacing.
+func (p *periodMeter) edge(t time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.seen = true
+	if n := len(p.edges); n > 0 {
+		p.lastPeriod = t.Sub(p.edges[n-1])
+	}
+	p.edges = append(p.edges, t)
+	i := 0
+	for i < len(p.edges)-1 && t.Sub(p.edges[i]) > PERIOD_WINDOW {
+		i++
+	}
+	p.edges = p.edges[i:]
+}
+
+// Pulses per second as of now, and whether there's a measurement at all.
+func (p *periodMeter) rate(now time.Time) (float64, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.seen {
+		return 0, false
+	}
+	n := len(p.edges)
+	last := p.edges[n-1]
+	since := now.Sub(last)
+	if since >= PERIOD_TIMEOUT || p.lastPeriod <= 0 {
+		return 0, true
+	}
+
+	// Mean period over the window, unless the gap since the last edge is already longer (slowing down).
+	period := p.lastPeriod
+	if n >= 2 {
+		period = last.Sub(p.edges[0]) / time.Duration(n-1)
+	}
+	if since > period {
+		period = since
+	}
+	return float64(time.Second) / float64(period), true
+}
+
+// Period rate at low flow, count rate at high flow, linear in between. units=pulses/sec.
+func blendFlowRate(periodRate, countRate float64) float64 {
+	w := (countRate - PERIOD_BLEND_LOW) / (PERIOD_BLEND_HIGH - PERIOD_BLEND_LOW)
+	if w < 0 {
+		w = 0
+	} else if w > 1 {
+		w = 1
+	}
+	return (1-w)*periodRate + w*countRate
+}
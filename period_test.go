@@ -0,0 +1,99 @@
+/*
+	Copyright (c) 2016 Christopher Young
+	Distributable under the terms of The "BSD New"" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	period_test.go: Edge period rate in sample time, and the blend with the count rate.
+*/
+
+package main
+
+import (
+	"math"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Samples captured over 2s of sample time, all delivered at once: the period comes from the
+// capture times, not from how fast detectEdges() got through the queue.
+func TestDetectEdgesPeriod(t *testing.T) {
+	p := periodMeter{mu: &sync.Mutex{}}
+
+	// 4 pulses/sec: 125ms high, 125ms low, sampled every 5ms.
+	const interval = 5 * time.Millisecond
+	t0 := time.Now()
+	in := make(chan inputSample, 400)
+	var last time.Time
+	for i := 0; i < 400; i++ {
+		mv := 0.0
+		if (i/25)%2 == 1 {
+			mv = 5000
+		}
+		last = t0.Add(time.Duration(i) * interval)
+		in <- inputSample{Time: last, Millivolts: mv}
+	}
+	close(in)
+	n := 0
+	detectEdges(in, noFilter{}, func(s inputSample, edge bool) {
+		n++
+		if edge {
+			p.edge(s.Time)
+		}
+	})
+	if n != 400 {
+		t.Errorf("%d samples passed on, want 400", n)
+	}
+
+	rate, ok := p.rate(last)
+	if !ok || math.Abs(rate-4) > 0.01 {
+		t.Errorf("period rate %0.3f pulses/sec (%v), want 4", rate, ok)
+	}
+	if n := len(p.edges); n < 4 || n > 5 {
+		t.Errorf("%d edges in the window, want 4 or 5", n)
+	}
+}
+
+func TestPeriodRate(t *testing.T) {
+	p := periodMeter{mu: &sync.Mutex{}}
+	t0 := time.Now()
+	if _, ok := p.rate(t0); ok {
+		t.Error("rate before any edge")
+	}
+	p.edge(t0)
+	if r, ok := p.rate(t0); !ok || r != 0 {
+		t.Errorf("one edge: %g, %v", r, ok)
+	}
+	for i := 1; i <= 10; i++ {
+		p.edge(t0.Add(time.Duration(i) * 500 * time.Millisecond))
+	}
+	end := t0.Add(5 * time.Second)
+	if r, _ := p.rate(end); r != 2 {
+		t.Errorf("every 500ms: %g pulses/sec, want 2", r)
+	}
+	// Slowing down: the open gap since the last edge sets the period.
+	if r, _ := p.rate(end.Add(time.Second)); r != 1 {
+		t.Errorf("1s after the last edge: %g pulses/sec, want 1", r)
+	}
+	if r, ok := p.rate(end.Add(PERIOD_TIMEOUT)); !ok || r != 0 {
+		t.Errorf("after the timeout: %g, %v", r, ok)
+	}
+}
+
+func TestBlendFlowRate(t *testing.T) {
+	tests := []struct {
+		period, count, want float64
+	}{
+		{3.2, 3, 3.2},
+		{10.5, PERIOD_BLEND_LOW, 10.5},
+		{50, 55, 52.5},
+		{101, PERIOD_BLEND_HIGH, 100},
+		{400, 420, 420},
+	}
+	for _, tt := range tests {
+		if got := blendFlowRate(tt.period, tt.count); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("blendFlowRate(%g, %g) = %g, want %g", tt.period, tt.count, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+/*
+	Copyright (c) 2016 Christopher Young
+	Distributable under the terms of The "BSD New"" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	quality.go: Signal quality of the ADC input over a rolling window. Plateau noise and rejected
+		samples from removeOutliersTwoSided(), edge sharpness from the time spent between the low and
+		high bands. Included in the stats as Signal_Quality.
+*/
+
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	QUALITY_WINDOW           = 10 * time.Second
+	QUALITY_PLATEAU_SAMPLES  = 256   // Most recent samples per plateau that go into removeOutliersTwoSided().
+	QUALITY_MIN_SAMPLES      = 16    // Fewer in the window: plateau not measured.
+	QUALITY_NOISE_LIMIT      = 250.0 // units=mV. Plateau noise at which the score hits 0; a quarter of the 1V band.
+	QUALITY_REJECT_LIMIT     = 0.2   // Rejected fraction at which the score hits 0.
+	QUALITY_SLOW_EDGE_LIMIT  = 4     // Samples between the bands per edge at which the score hits 0.
+	QUALITY_SCORE_UNMEASURED = -1
+)
+
+type signalQualityStatus struct {
+	Score          float64 // 0-100, from the worst of noise, rejected samples and edges. -1 until measured.
+	Low_Noise_mV   float64 // Standard deviation of the low plateau, outliers removed.
+	High_Noise_mV  float64
+	Rejected_Pct   float64 // Plateau samples removeOutliersTwoSided() dropped.
+	Edge_Rise_ms   float64 // Mean time from the last low sample to the first high one.
+	Edge_Samples   float64 // Mean samples between the bands per edge. 0 = clean step.
+	Edges          int
+	Window_Seconds float64
+}
+
+type qualitySample struct {
+	t  time.Time
+	mv float64
+}
+
+type qualityEdge struct {
+	t       time.Time
+	rise    time.Duration
+	samples int
+}
+
+type signalQuality struct {
+	low   []qualitySample // Oldest first. Trimmed to QUALITY_PLATEAU_SAMPLES when evaluated.
+	high  []qualitySample
+	edges []qualityEdge
+
+	lastLow  time.Time // Zero if not rising from low.
+	between  int       // Samples between the bands since lastLow.
+	wasHigh  bool
+	measured bool
+	mu       *sync.Mutex
+}
+
+var quality = signalQuality{mu: &sync.Mutex{}}
+
+// A raw sample, before filtering. Same bands as processInput().
+func (q *signalQuality) sample(t time.Time, mv float64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.measured = true
+
+	switch {
+	case math.Abs(mv) <= 1000:
+		q.low = appendQualitySample(q.low, qualitySample{t, mv})
+		q.lastLow = t
+		q.between = 0
+		q.wasHigh = false
+	case math.Abs(mv-5000) <= 1000:
+		q.high = appendQualitySample(q.high, qualitySample{t, mv})
+		if !q.wasHigh && !q.lastLow.IsZero() {
+			q.edges = append(q.edges, qualityEdge{t: t, rise: t.Sub(q.lastLow), samples: q.between})
+		}
+		q.lastLow = time.Time{}
+		q.wasHigh = true
+	default:
+		q.between++
+	}
+}
+
+// Keeps up to twice QUALITY_PLATEAU_SAMPLES so the trim is amortized.
+func appendQualitySample(s []qualitySample, v qualitySample) []qualitySample {
+	if len(s) >= 2*QUALITY_PLATEAU_SAMPLES {
+		n := copy(s, s[len(s)-QUALITY_PLATEAU_SAMPLES:])
+		s = s[:n]
+	}
+	return append(s, v)
+}
+
+// Noise and rejected count of the plateau samples within the window. ok is false if there are too few.
+func plateauNoise(s []qualitySample, since time.Time) (noise float64, n, rejected int, ok bool) {
+	if len(s) > QUALITY_PLATEAU_SAMPLES {
+		s = s[len(s)-QUALITY_PLATEAU_SAMPLES:]
+	}
+	mv := make([]float64, 0, len(s))
+	for _, v := range s {
+		if !v.t.Before(since) {
+			mv = append(mv, v.mv)
+		}
+	}
+	if len(mv) < QUALITY_MIN_SAMPLES {
+		return 0, 0, 0, false
+	}
+	_, stdev, kept := removeOutliersTwoSided(mv)
+	return stdev, len(mv), len(mv) - kept, true
+}
+
+func qualityFactor(v, limit float64) float64 {
+	return math.Max(0, 1-v/limit)
+}
+
+// Current status as of t.
+func (q *signalQuality) evaluate(t time.Time) signalQualityStatus {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	s := signalQualityStatus{Score: QUALITY_SCORE_UNMEASURED, Window_Seconds: QUALITY_WINDOW.Seconds()}
+	if !q.measured {
+		return s // Counter chip input, or nothing read yet.
+	}
+	since := t.Add(-QUALITY_WINDOW)
+
+	i := 0
+	for i < len(q.edges) && q.edges[i].t.Before(since) {
+		i++
+	}
+	q.edges = q.edges[i:]
+
+	score := 1.0
+	measured := false
+	samples, rejected := 0, 0
+	if noise, n, r, ok := plateauNoise(q.low, since); ok {
+		s.Low_Noise_mV = noise
+		score = math.Min(score, qualityFactor(noise, QUALITY_NOISE_LIMIT))
+		samples += n
+		rejected += r
+		measured = true
+	}
+	if noise, n, r, ok := plateauNoise(q.high, since); ok {
+		s.High_Noise_mV = noise
+		score = math.Min(score, qualityFactor(noise, QUALITY_NOISE_LIMIT))
+		samples += n
+		rejected += r
+		measured = true
+	}
+	if samples > 0 {
+		frac := float64(rejected) / float64(samples)
+		s.Rejected_Pct = frac * 100
+		score = math.Min(score, qualityFactor(frac, QUALITY_REJECT_LIMIT))
+	}
+	if s.Edges = len(q.edges); s.Edges > 0 {
+		var rise time.Duration
+		between := 0
+		for _, e := range q.edges {
+			rise += e.rise
+			between += e.samples
+		}
+		s.Edge_Rise_ms = (rise / time.Duration(s.Edges)).Seconds() * 1000
+		s.Edge_Samples = float64(between) / float64(s.Edges)
+		score = math.Min(score, qualityFactor(s.Edge_Samples, QUALITY_SLOW_EDGE_LIMIT))
+		measured = true
+	}
+	if measured {
+		s.Score = score * 100
+	}
+	return s
+}
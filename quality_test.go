@@ -0,0 +1,60 @@
+/*
+	Copyright (c) 2016 Christopher Young
+	Distributable under the terms of The "BSD New"" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	quality_test.go: Signal quality scoring on clean, noisy and offset waveforms.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 0/5V square wave, 10 samples per half cycle at 860 SPS, offset by low mV on the low plateau.
+// spike(i) is added to sample i.
+func feedSquareWave(q *signalQuality, t0 time.Time, low float64, spike func(i int) float64) {
+	dt := time.Second / 860
+	for i := 0; i < 8600; i++ {
+		mv := low
+		if (i/10)%2 == 1 {
+			mv = 5000
+		}
+		q.sample(t0.Add(time.Duration(i)*dt), mv+spike(i))
+	}
+}
+
+func TestSignalQuality(t *testing.T) {
+	q := signalQuality{mu: &sync.Mutex{}}
+	if s := q.evaluate(time.Now()); s.Score != QUALITY_SCORE_UNMEASURED {
+		t.Fatalf("unmeasured score %g", s.Score)
+	}
+
+	t0 := time.Now()
+	feedSquareWave(&q, t0, 0, func(i int) float64 { return float64(i%3) * 4 })
+	clean := q.evaluate(t0.Add(10 * time.Second))
+	if clean.Score < 95 || clean.Rejected_Pct != 0 || clean.Edges != 430 {
+		t.Errorf("clean: %+v", clean)
+	}
+
+	// Negative offset and negative spikes on the low plateau: rejected, not a panic.
+	q = signalQuality{mu: &sync.Mutex{}}
+	feedSquareWave(&q, t0, -150, func(i int) float64 {
+		if i%100 == 3 {
+			return -700
+		}
+		return float64(i%3) * 4
+	})
+	offset := q.evaluate(t0.Add(10 * time.Second))
+	if offset.Rejected_Pct <= 0 || offset.Low_Noise_mV > 50 || offset.Score >= clean.Score {
+		t.Errorf("negative spikes: %+v", offset)
+	}
+	if _, err := json.Marshal(offset); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,117 @@
+/*
+	Copyright (c) 2016 Christopher Young
+	Distributable under the terms of The "BSD New"" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	rates.go: Windowed event counters driven by sample capture time rather than the wall clock,
+		so queueing delay and scheduling jitter don't move counts between windows.
+*/
+
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Stop trusting the sample clock if no sample has arrived for this long (input stalled).
+const SAMPLE_CLOCK_STALE = 1 * time.Second
+
+// Times are kept as nanoseconds since monoOrigin so they fit in an int64 for atomic access. Taken
+// with time.Now(), so offsets (and times rebuilt from them) use the monotonic clock.
+var monoOrigin = time.Now()
+
+func monoNanos(t time.Time) int64 {
+	return int64(t.Sub(monoOrigin))
+}
+
+// Events over the trailing window, in buckets of window/len(buckets). Lock free: each bucket is one
+// word, the bucket's epoch (index since monoOrigin) in the high 32 bits and its count in the low 32.
+type rateCounter struct {
+	buckets []uint64
+	res     int64 // Bucket width, ns.
+}
+
+func newRateCounter(window time.Duration, buckets int) *rateCounter {
+	return &rateCounter{buckets: make([]uint64, buckets), res: int64(window) / int64(buckets)}
+}
+
+func (r *rateCounter) epoch(t time.Time) (uint32, bool) {
+	d := monoNanos(t)
+	if d < 0 {
+		return 0, false
+	}
+	return uint32(d / r.res), true
+}
+
+func (r *rateCounter) Incr(t time.Time, n int64) {
+	e, ok := r.epoch(t)
+	if !ok {
+		return
+	}
+	b := &r.buckets[int(e)%len(r.buckets)]
+	for {
+		old := atomic.LoadUint64(b)
+		oldEpoch := uint32(old >> 32)
+		var v uint64
+		switch {
+		case oldEpoch == e:
+			v = old + uint64(n)
+		case int32(oldEpoch-e) > 0:
+			return // Bucket already reused by a later epoch, t is out of the window.
+		default:
+			v = uint64(e)<<32 | uint64(n)
+		}
+		if atomic.CompareAndSwapUint64(b, old, v) {
+			return
+		}
+	}
+}
+
+// Events in the window ending at now.
+func (r *rateCounter) Rate(now time.Time) int64 {
+	e, ok := r.epoch(now)
+	if !ok {
+		return 0
+	}
+	sum := int64(0)
+	for i := range r.buckets {
+		v := atomic.LoadUint64(&r.buckets[i])
+		if age := e - uint32(v>>32); age < uint32(len(r.buckets)) {
+			sum += int64(v & 0xffffffff)
+		}
+	}
+	return sum
+}
+
+// Capture time of the latest input sample. Rates are evaluated against it.
+type sampleClock struct {
+	t int64 // monoNanos()+1 of the latest sample, 0 before the first.
+}
+
+var inputClock sampleClock
+
+func (c *sampleClock) set(t time.Time) {
+	n := monoNanos(t) + 1
+	for {
+		old := atomic.LoadInt64(&c.t)
+		if n <= old || atomic.CompareAndSwapInt64(&c.t, old, n) {
+			return
+		}
+	}
+}
+
+// Latest sample time, or the wall clock if samples have stopped coming.
+func (c *sampleClock) now() time.Time {
+	n := atomic.LoadInt64(&c.t)
+	now := time.Now()
+	if n == 0 {
+		return now
+	}
+	t := monoOrigin.Add(time.Duration(n - 1))
+	if now.Sub(t) > SAMPLE_CLOCK_STALE {
+		return now
+	}
+	return t
+}
@@ -0,0 +1,98 @@
+/*
+	Copyright (c) 2016 Christopher Young
+	Distributable under the terms of The "BSD New"" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	rollup.go: Per-minute and per-hour rollups of fuel_flow and raw row retention, for the SQLite
+		backend. Run from Maintain() on the logger goroutine so that there is only ever one writer.
+		The rollups themselves are kept forever: fuel_flow_minute is at most 525,600 rows a year
+		(around 15MB), and it's all History() has for minutes whose raw rows are gone.
+*/
+
+package main
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Start of the newest bucket already rolled up, or the first raw row if there are none.
+// The newest bucket is recomputed since it may have been partial last time.
+func rollupStart(tx *sql.Tx, rollupQuery, rawQuery string) (int64, bool, error) {
+	var t sql.NullInt64
+	if err := tx.QueryRow(rollupQuery).Scan(&t); err != nil {
+		return 0, false, err
+	}
+	if t.Valid {
+		return t.Int64, true, nil
+	}
+	if err := tx.QueryRow(rawQuery).Scan(&t); err != nil {
+		return 0, false, err
+	}
+	return t.Int64, t.Valid, nil
+}
+
+// Bring fuel_flow_minute and fuel_flow_hour up to date. Only complete buckets are written.
+func dbRollup(db *sql.DB, now time.Time) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	curMinute := now.Unix() / 60 * 60
+	from, ok, err := rollupStart(tx, "SELECT MAX(minute) FROM fuel_flow_minute", "SELECT MIN(log_date_start) FROM fuel_flow")
+	if err != nil {
+		return err
+	}
+	if ok {
+		_, err = tx.Exec(`INSERT OR REPLACE INTO fuel_flow_minute(minute, pulses, flow, samples)
+			SELECT (log_date_start / 60) * 60 AS m, SUM(pulses), SUM(flow), COUNT(*) FROM fuel_flow
+			WHERE log_date_start >= ? AND log_date_start < ? GROUP BY m`, from/60*60, curMinute)
+		if err != nil {
+			return err
+		}
+	}
+
+	curHour := now.Unix() / 3600 * 3600
+	from, ok, err = rollupStart(tx, "SELECT MAX(hour) FROM fuel_flow_hour", "SELECT MIN(minute) FROM fuel_flow_minute")
+	if err != nil {
+		return err
+	}
+	if ok {
+		_, err = tx.Exec(`INSERT OR REPLACE INTO fuel_flow_hour(hour, pulses, flow, samples)
+			SELECT (minute / 3600) * 3600 AS h, SUM(pulses), SUM(flow), SUM(samples) FROM fuel_flow_minute
+			WHERE minute >= ? AND minute < ? GROUP BY h`, from/3600*3600, curHour)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Delete raw rows older than RawRetentionDays, but only once they have been rolled up.
+func dbPrune(db *sql.DB, now time.Time) error {
+	cutoff := rawRetentionCutoff(now)
+	if cutoff == 0 {
+		return nil
+	}
+	res, err := db.Exec(`DELETE FROM fuel_flow WHERE log_date_start < ?
+		AND log_date_start < (SELECT IFNULL(MAX(minute), 0) FROM fuel_flow_minute)`, cutoff)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		logger.Debugf("pruned %d raw rows.\n", n)
+	}
+	return nil
+}
+
+// Oldest raw row still kept, unix seconds. Anything before this is only in the rollups.
+func rawRetentionCutoff(now time.Time) int64 {
+	if globalSettings.RawRetentionDays <= 0 {
+		return 0
+	}
+	return now.Add(-time.Duration(globalSettings.RawRetentionDays) * 24 * time.Hour).Unix()
+}
@@ -0,0 +1,259 @@
+//go:build cgo
+// +build cgo
+
+/*
+	Copyright (c) 2016 Christopher Young
+	Distributable under the terms of The "BSD New"" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	rollup_test.go: Minute and hour rollups, raw row pruning and the History() source switch.
+*/
+
+package main
+
+import (
+	"database/sql"
+	"math"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Fresh database with the rollup fixture: three samples in hour h's first minute, two in its
+// second, and one in the minute before now (not complete, so not rolled up).
+func newRollupFixture(t *testing.T, h, now time.Time) *sqliteStorage {
+	st, err := openStorage("sqlite", filepath.Join(t.TempDir(), "flowfast.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { st.Close() })
+	rows := []fuel_log{}
+	for _, off := range []int{0, 1, 2} {
+		rows = append(rows, rollupSample(h.Add(time.Duration(off)*time.Second), 0.01, 10))
+	}
+	for _, off := range []int{60, 61} {
+		rows = append(rows, rollupSample(h.Add(time.Duration(off)*time.Second), 0.02, 20))
+	}
+	rows = append(rows, rollupSample(now.Add(-time.Second), 0.05, 50))
+	if err := st.AppendSamples(rows); err != nil {
+		t.Fatal(err)
+	}
+	return st.(*sqliteStorage)
+}
+
+func rollupSample(t time.Time, flow float64, pulses uint64) fuel_log {
+	return fuel_log{log_date_start: t, log_date_end: t.Add(time.Second), flow: flow, pulses: pulses, k_factor: 68000}
+}
+
+type rollupRow struct {
+	t       int64
+	pulses  int64
+	flow    float64
+	samples int64
+}
+
+func queryRollup(t *testing.T, db *sql.DB, q string) []rollupRow {
+	rows, err := db.Query(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	ret := []rollupRow{}
+	for rows.Next() {
+		var r rollupRow
+		if err := rows.Scan(&r.t, &r.pulses, &r.flow, &r.samples); err != nil {
+			t.Fatal(err)
+		}
+		ret = append(ret, r)
+	}
+	return ret
+}
+
+func checkRollup(t *testing.T, name string, got, want []rollupRow) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("%s: %+v, want %+v", name, got, want)
+	}
+	for i := range got {
+		if got[i].t != want[i].t || got[i].pulses != want[i].pulses || got[i].samples != want[i].samples || math.Abs(got[i].flow-want[i].flow) > 1e-9 {
+			t.Errorf("%s[%d]: %+v, want %+v", name, i, got[i], want[i])
+		}
+	}
+}
+
+func countRaw(t *testing.T, db *sql.DB) int {
+	var n int
+	if err := db.QueryRow("SELECT COUNT(*) FROM fuel_flow").Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestDBRollup(t *testing.T) {
+	h := time.Unix(1700002800, 0) // On the hour.
+	now := h.Add(2*time.Hour + 30*time.Second)
+	st := newRollupFixture(t, h, now)
+
+	if err := dbRollup(st.db, now); err != nil {
+		t.Fatal(err)
+	}
+	minutes := []rollupRow{{h.Unix(), 30, 0.03, 3}, {h.Unix() + 60, 40, 0.04, 2}}
+	checkRollup(t, "minutes", queryRollup(t, st.db, "SELECT minute, pulses, flow, samples FROM fuel_flow_minute ORDER BY minute"), minutes)
+	hours := []rollupRow{{h.Unix(), 70, 0.07, 5}}
+	checkRollup(t, "hours", queryRollup(t, st.db, "SELECT hour, pulses, flow, samples FROM fuel_flow_hour ORDER BY hour"), hours)
+
+	// A late sample in the newest rolled-up minute is picked up by the next run, and the minute
+	// before now is rolled up once it's complete.
+	if err := st.AppendSamples([]fuel_log{rollupSample(h.Add(62*time.Second), 0.02, 20)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := dbRollup(st.db, now.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	last := now.Add(-time.Second).Unix() / 60 * 60
+	minutes = []rollupRow{{h.Unix(), 30, 0.03, 3}, {h.Unix() + 60, 60, 0.06, 3}, {last, 50, 0.05, 1}}
+	checkRollup(t, "minutes after a late sample", queryRollup(t, st.db, "SELECT minute, pulses, flow, samples FROM fuel_flow_minute ORDER BY minute"), minutes)
+	hours = []rollupRow{{h.Unix(), 90, 0.09, 6}}
+	checkRollup(t, "hours after a late sample", queryRollup(t, st.db, "SELECT hour, pulses, flow, samples FROM fuel_flow_hour ORDER BY hour"), hours)
+
+	// Nothing to do on an empty database.
+	empty, err := openStorage("sqlite", filepath.Join(t.TempDir(), "empty.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer empty.Close()
+	if err := dbRollup(empty.(*sqliteStorage).db, now); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRawRetentionCutoff(t *testing.T) {
+	saved := globalSettings
+	defer func() { globalSettings = saved }()
+
+	now := time.Unix(1700000000, 0)
+	globalSettings.RawRetentionDays = 0
+	if c := rawRetentionCutoff(now); c != 0 {
+		t.Errorf("keep forever: cutoff %d", c)
+	}
+	globalSettings.RawRetentionDays = 2
+	if c := rawRetentionCutoff(now); c != now.Unix()-2*86400 {
+		t.Errorf("2 days: cutoff %d, want %d", c, now.Unix()-2*86400)
+	}
+}
+
+func TestDBPrune(t *testing.T) {
+	saved := globalSettings
+	defer func() { globalSettings = saved }()
+	globalSettings.RawRetentionDays = 1
+
+	h := time.Unix(1700002800, 0)
+	now := h.Add(48 * time.Hour) // The fixture's first two minutes are past the cutoff.
+	st := newRollupFixture(t, h, now)
+
+	// Not rolled up yet: nothing goes.
+	if err := dbPrune(st.db, now); err != nil {
+		t.Fatal(err)
+	}
+	if n := countRaw(t, st.db); n != 6 {
+		t.Fatalf("%d raw rows after pruning before the rollup, want 6", n)
+	}
+
+	if err := dbRollup(st.db, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := dbPrune(st.db, now); err != nil {
+		t.Fatal(err)
+	}
+	if n := countRaw(t, st.db); n != 1 {
+		t.Errorf("%d raw rows after pruning, want only the one inside the retention window", n)
+	}
+	// The minute totals don't depend on the raw rows any more.
+	if err := dbRollup(st.db, now.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	minutes := queryRollup(t, st.db, "SELECT minute, pulses, flow, samples FROM fuel_flow_minute ORDER BY minute")
+	checkRollup(t, "minutes after pruning", minutes[:2], []rollupRow{{h.Unix(), 30, 0.03, 3}, {h.Unix() + 60, 40, 0.04, 2}})
+
+	// Old rows in the newest rolled-up minute stay until a newer minute is rolled up: that minute
+	// is recomputed from them on the next run.
+	st2 := newRollupFixture(t, h, h.Add(90*time.Second))
+	if err := dbRollup(st2.db, h.Add(2*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if err := dbPrune(st2.db, now); err != nil {
+		t.Fatal(err)
+	}
+	if n := countRaw(t, st2.db); n != 3 {
+		t.Errorf("%d raw rows left, want the newest rolled-up minute's 3", n)
+	}
+
+	globalSettings.RawRetentionDays = 0
+	if err := dbRollup(st2.db, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := dbPrune(st2.db, now); err != nil {
+		t.Fatal(err)
+	}
+	if n := countRaw(t, st2.db); n != 3 {
+		t.Errorf("pruned %d raw rows with retention off", 3-n)
+	}
+}
+
+func TestSQLiteHistory(t *testing.T) {
+	h := time.Unix(1700002800, 0)
+	now := h.Add(2*time.Hour + 30*time.Second)
+	st := newRollupFixture(t, h, now)
+	last := now.Add(-time.Second).Unix() / 60 * 60
+
+	check := func(name string, got []historyPoint, want []historyPoint) {
+		t.Helper()
+		if len(got) != len(want) {
+			t.Fatalf("%s: %+v, want %+v", name, got, want)
+		}
+		for i := range got {
+			if got[i].Time != want[i].Time || math.Abs(got[i].GPH-want[i].GPH) > 1e-9 {
+				t.Errorf("%s[%d]: %+v, want %+v", name, i, got[i], want[i])
+			}
+		}
+	}
+
+	// Nothing rolled up: all from the raw rows, including the current minute.
+	p, err := st.History(now.Add(-3*time.Hour), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("raw only", p, []historyPoint{{h.Unix(), 0.03 * 60}, {h.Unix() + 60, 0.04 * 60}, {last, 0.05 * 60}})
+
+	// Rolled up and the old raw rows gone: minutes before the newest rolled-up one come from
+	// the rollup, the rest from raw rows.
+	if err := dbRollup(st.db, now); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.db.Exec("DELETE FROM fuel_flow WHERE log_date_start < ?", h.Unix()+60); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.db.Exec("UPDATE fuel_flow_minute SET flow = 0.5 WHERE minute = ?", h.Unix()+60); err != nil {
+		t.Fatal(err)
+	}
+	p, err = st.History(now.Add(-3*time.Hour), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("rollup then raw", p, []historyPoint{{h.Unix(), 0.03 * 60}, {h.Unix() + 60, 0.04 * 60}, {last, 0.05 * 60}})
+
+	// Starting after the boundary: raw rows only.
+	p, err = st.History(time.Unix(last, 0), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("after the boundary", p, []historyPoint{{last, 0.05 * 60}})
+
+	// Past HISTORY_MINUTE_MAX: complete hours from the hour rollup.
+	p, err = st.History(now.Add(-(HISTORY_MINUTE_MAX+1)*time.Minute), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("hours", p, []historyPoint{{h.Unix(), 0.07}})
+}
@@ -0,0 +1,91 @@
+/*
+	Copyright (c) 2016 Christopher Young
+	Distributable under the terms of The "BSD New"" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	session.go: Engine run / flight session tracking.
+*/
+
+package main
+
+import (
+	"time"
+)
+
+const (
+	EVENT_TYPE_SESSION = "session"
+)
+
+// A session starts with the first pulse and ends after SessionIdleMinutes without flow.
+type sessionSummary struct {
+	Start     time.Time
+	End       time.Time // Time of the last pulse.
+	Fuel_Used float64   // units=gallons.
+	Avg_GPH   float64
+	Max_GPH   float64 // Highest per-minute flow seen.
+	Pulses    uint64
+}
+
+type sessionTracker struct {
+	active   bool
+	start    time.Time
+	lastFlow time.Time
+	startRaw uint64
+	lastRaw  uint64
+	maxGPH   float64
+}
+
+var sessions sessionTracker
+
+func (s *sessionTracker) summary() sessionSummary {
+	ret := sessionSummary{
+		Start:   s.start,
+		End:     s.lastFlow,
+		Pulses:  s.lastRaw - s.startRaw,
+		Max_GPH: s.maxGPH,
+	}
+	ret.Fuel_Used = float64(ret.Pulses) * gallonsPerClick()
+	if hours := ret.End.Sub(ret.Start).Hours(); hours > 0 {
+		ret.Avg_GPH = ret.Fuel_Used / hours
+	}
+	return ret
+}
+
+// Called once per stats update with the running pulse total. Only from statsCalculator().
+func (s *sessionTracker) update(t time.Time, totalRaw uint64, minuteGPH float64) {
+	flowing := totalRaw != s.lastRaw
+	prevRaw := s.lastRaw
+	s.lastRaw = totalRaw
+
+	if flowing {
+		if !s.active {
+			s.active = true
+			s.start = t
+			s.startRaw = prevRaw
+			s.maxGPH = 0
+			logger.Debugf("session started.\n")
+		}
+		s.lastFlow = t
+	}
+
+	if !s.active {
+		return
+	}
+
+	if minuteGPH > s.maxGPH {
+		s.maxGPH = minuteGPH
+	}
+
+	if t.Sub(s.lastFlow) >= time.Duration(globalSettings.SessionIdleMinutes)*time.Minute {
+		s.active = false
+		sum := s.summary()
+		logger.Debugf("session ended: %0.2f gal in %s.\n", sum.Fuel_Used, sum.End.Sub(sum.Start))
+		events.publish(EVENT_TYPE_SESSION, sum, true)
+		select {
+		case sessionLogChan <- sum:
+		default:
+			logger.Errorf("session log queue full, session not saved.\n")
+		}
+	}
+}
@@ -0,0 +1,356 @@
+/*
+	Copyright (c) 2016 Christopher Young
+	Distributable under the terms of The "BSD New"" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	storage.go: Storage backend interface and the logger goroutine that feeds it.
+		Backends register themselves in storageBackends: "sqlite" (cgo builds only),
+		"flatfile" (append-only JSON lines) and "memory".
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SAMPLE_BATCH_MAX      = 600  // Append early if this many samples are pending.
+	SAMPLE_BATCH_KEEP_MAX = 3600 // Samples held across failed appends before giving up on them.
+	STORAGE_MAINT_DELAY   = 1 * time.Minute
+
+	// Backoff between attempts to open storage.
+	STORAGE_REOPEN_DELAY_MIN = 1 * time.Second
+	STORAGE_REOPEN_DELAY_MAX = 1 * time.Minute
+)
+
+// K-factor change record, so stored pulse counts can be converted with the right value.
+type calibration struct {
+	Time    time.Time
+	KFactor float64 // Pulses per gallon.
+	Note    string
+}
+
+type storage interface {
+	AppendSamples(samples []fuel_log) error
+	AppendSession(s sessionSummary) error
+	AppendCalibration(c calibration) error
+
+	// Range queries, start inclusive, end exclusive, in time order. Stop early if fn returns an error.
+	QuerySamples(from, to time.Time, fn func(fuel_log) error) error
+	QuerySessions(from, to time.Time, fn func(sessionSummary) error) error
+	LatestCalibration() (calibration, bool, error)
+
+	// Average flow since the given time, at a resolution picked by the backend.
+	History(since, now time.Time) ([]historyPoint, error)
+
+	// Periodic housekeeping (rollups, retention).
+	Maintain(now time.Time) error
+	// Flush everything to durable storage and release it.
+	Close() error
+}
+
+// Backend constructors by name, taking StoragePath.
+var storageBackends = make(map[string]func(path string) (storage, error))
+
+// Read-only constructors, for reading storage the daemon may be writing at the same time (export).
+// No schema changes or housekeeping; the Append and Maintain methods return errStorageReadOnly.
+var storageReaders = make(map[string]func(path string) (storage, error))
+
+var errStorageReadOnly = errors.New("storage opened read-only")
+
+func openStorage(backend, path string) (storage, error) {
+	return openStorageFrom(storageBackends, backend, path)
+}
+
+func openStorageReadOnly(backend, path string) (storage, error) {
+	return openStorageFrom(storageReaders, backend, path)
+}
+
+func openStorageFrom(constructors map[string]func(path string) (storage, error), backend, path string) (storage, error) {
+	open, ok := constructors[backend]
+	if !ok {
+		names := make([]string, 0, len(constructors))
+		for k := range constructors {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown storage backend '%s' (have: %s)", backend, strings.Join(names, ", "))
+	}
+	return open(path)
+}
+
+// Per-minute buckets for ranges up to HISTORY_MINUTE_MAX, per-hour beyond. For backends without rollups.
+func historyBuckets(since, now time.Time) int64 {
+	if now.Sub(since) <= HISTORY_MINUTE_MAX*time.Minute {
+		return 60
+	}
+	return 3600
+}
+
+// Sum samples into buckets of bucketSecs. For backends without rollups.
+func bucketSamples(st storage, since, now time.Time) ([]historyPoint, error) {
+	bucketSecs := historyBuckets(since, now)
+	ret := make([]historyPoint, 0)
+	err := st.QuerySamples(since, now, func(f fuel_log) error {
+		t := f.log_date_start.Unix() / bucketSecs * bucketSecs
+		if len(ret) == 0 || ret[len(ret)-1].Time != t {
+			ret = append(ret, historyPoint{Time: t})
+		}
+		ret[len(ret)-1].GPH += f.flow * float64(3600.0) / float64(bucketSecs)
+		return nil
+	})
+	return ret, err
+}
+
+var logChan = make(chan fuel_log, 1024)
+
+// Delay before the first retry of a failed open, doubling up to STORAGE_REOPEN_DELAY_MAX.
+var storageReopenDelay = STORAGE_REOPEN_DELAY_MIN
+
+// Closed sessions waiting to be written, fed by the session tracker.
+var sessionLogChan = make(chan sessionSummary, 16)
+
+// Signalled by the supply monitor when power is about to go.
+var emergencyFlushChan = make(chan struct{}, 1)
+
+func requestEmergencyFlush() {
+	select {
+	case emergencyFlushChan <- struct{}{}:
+	default:
+	}
+}
+
+// Open by storageLogger(), shared with the history and export handlers through withFuelStore().
+var fuelStore storage
+var fuelStoreMu = &sync.RWMutex{}
+
+func setFuelStore(st storage) {
+	fuelStoreMu.Lock()
+	fuelStore = st
+	fuelStoreMu.Unlock()
+}
+
+// Run fn against the open store. Closing the store waits for fn to return. ok is false if storage
+// isn't open.
+func withFuelStore(fn func(st storage) error) (ok bool, err error) {
+	fuelStoreMu.RLock()
+	defer fuelStoreMu.RUnlock()
+	if fuelStore == nil {
+		return false, nil
+	}
+	return true, fn(fuelStore)
+}
+
+// Record the configured K-factor if it differs from the last one stored.
+func checkCalibration(st storage) error {
+	c, ok, err := st.LatestCalibration()
+	if err != nil {
+		return err
+	}
+	if ok && c.KFactor == globalSettings.KFactor {
+		return nil
+	}
+	logger.Debugf("recording K-factor %f.\n", globalSettings.KFactor)
+	return st.AppendCalibration(calibration{Time: time.Now(), KFactor: globalSettings.KFactor, Note: "settings"})
+}
+
+// Journaled samples that didn't make it into storage last time. A crash between a storage
+// write and the journal checkpoint leaves samples in both, those are skipped.
+func replayJournal(st storage, replay []fuel_log) ([]fuel_log, error) {
+	if len(replay) == 0 {
+		return replay, nil
+	}
+	stored := make(map[int64]bool)
+	err := st.QuerySamples(replay[0].log_date_start, replay[len(replay)-1].log_date_start.Add(1), func(f fuel_log) error {
+		stored[f.log_date_start.UnixNano()] = true
+		return nil
+	})
+	if err != nil {
+		return replay, err
+	}
+
+	fresh := make([]fuel_log, 0, len(replay))
+	for _, f := range replay {
+		if !stored[f.log_date_start.UnixNano()] {
+			fresh = append(fresh, f)
+		}
+	}
+	logger.Debugf("replaying %d journaled samples (%d already stored).\n", len(fresh), len(replay)-len(fresh))
+	return fresh, nil
+}
+
+// Batches samples from logChan into the configured storage backend. Each sample goes through
+// the journal first. replay holds samples from the journal of the previous run, and remaining
+// the totalizer value to checkpoint until new samples arrive. If the backend can't be opened,
+// samples are still journaled and the open is retried with backoff. Returns once logChan has been
+// closed and everything is flushed.
+func storageLogger(replay []fuel_log, remaining float64) {
+	defer journal.close()
+
+	var st storage // nil until opened.
+	defer func() {
+		if st != nil {
+			setFuelStore(nil) // Waits for handlers still using it.
+			st.Close()
+		}
+	}()
+
+	ticker := time.NewTicker(time.Duration(globalSettings.DBCommitSeconds) * time.Second)
+	defer ticker.Stop()
+	maintTicker := time.NewTicker(STORAGE_MAINT_DELAY)
+	defer maintTicker.Stop()
+
+	batch := make([]fuel_log, 0, SAMPLE_BATCH_MAX)
+	sessions := make([]sessionSummary, 0) // Closed while storage isn't open.
+	// Set once samples have been dropped unstored. The journal is their only copy from then on, so
+	// it isn't checkpointed again this run; the next start replays it.
+	stranded := false
+	checkpoint := func() {
+		if stranded {
+			return
+		}
+		if err := journal.checkpoint(remaining); err != nil {
+			logger.Errorf("journal checkpoint: %s\n", err.Error())
+		}
+	}
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if st == nil {
+			// Journaled already. Only bound what's held in memory.
+			if n := len(batch) - SAMPLE_BATCH_KEEP_MAX; n > 0 {
+				logger.Errorf("storage not open, dropping %d samples, keeping them in the journal for the next start.\n", n)
+				batch = append(batch[:0], batch[n:]...)
+				stranded = true
+			}
+			return
+		}
+		t := time.Now()
+		err := st.AppendSamples(batch)
+		metrics.dbWrite(time.Since(t), err)
+		if err != nil {
+			logger.Errorf("AppendSamples(): %s\n", err.Error())
+			if len(batch) < SAMPLE_BATCH_KEEP_MAX {
+				return // Keep the samples and try again next time.
+			}
+			logger.Errorf("dropping %d samples, keeping them in the journal for the next start.\n", len(batch))
+			stranded = true
+		}
+		batch = batch[:0]
+		checkpoint()
+	}
+
+	take := func(f fuel_log) {
+		if err := journal.append(f); err != nil {
+			logger.Errorf("journal append: %s\n", err.Error())
+		}
+		remaining = f.fuel_remaining
+		batch = append(batch, f)
+	}
+
+	open := func() bool {
+		s, err := openStorage(globalSettings.StorageBackend, globalSettings.StoragePath)
+		if err != nil {
+			logger.Errorf("openStorage(): %s\n", err.Error())
+			return false
+		}
+		st = s
+		if err := checkCalibration(st); err != nil {
+			logger.Errorf("checkCalibration(): %s\n", err.Error())
+		}
+		setFuelStore(st)
+
+		// Replayed samples go out ahead of anything taken while waiting, and stay in the journal
+		// until they're stored.
+		fresh, err := replayJournal(st, replay)
+		if err != nil {
+			logger.Errorf("replayJournal(): %s\n", err.Error())
+		}
+		batch = append(fresh, batch...)
+		flush()
+		for _, sum := range sessions {
+			if err := st.AppendSession(sum); err != nil {
+				logger.Errorf("AppendSession(): %s\n", err.Error())
+			}
+		}
+		sessions = nil
+		return true
+	}
+
+	var retry <-chan time.Time // Set while storage isn't open.
+	retryDelay := storageReopenDelay
+	if !open() {
+		retry = time.After(retryDelay)
+	}
+
+	for {
+		select {
+		case f, ok := <-logChan:
+			if !ok {
+				flush() // Shutting down. Close() makes it durable.
+				if st == nil {
+					logger.Errorf("storage never opened, %d samples left in the journal.\n", len(batch))
+				}
+				return
+			}
+			take(f)
+			if len(batch) >= SAMPLE_BATCH_MAX {
+				flush()
+			}
+		case <-retry:
+			if open() {
+				retry = nil
+				break
+			}
+			if retryDelay *= 2; retryDelay > STORAGE_REOPEN_DELAY_MAX {
+				retryDelay = STORAGE_REOPEN_DELAY_MAX
+			}
+			retry = time.After(retryDelay)
+		case <-emergencyFlushChan:
+			// Take what's queued and store it now, there may not be a next tick.
+			for n := len(logChan); n > 0; n-- {
+				f, ok := <-logChan
+				if !ok {
+					break
+				}
+				take(f)
+			}
+			if st == nil {
+				break // Journaled, nothing more to do.
+			}
+			if len(batch) > 0 {
+				flush()
+			} else {
+				checkpoint()
+			}
+		case <-ticker.C:
+			flush()
+		case s := <-sessionLogChan:
+			if st == nil {
+				if len(sessions) < cap(sessionLogChan) {
+					sessions = append(sessions, s)
+				}
+				break
+			}
+			if err := st.AppendSession(s); err != nil {
+				logger.Errorf("AppendSession(): %s\n", err.Error())
+			}
+		case <-maintTicker.C:
+			if st == nil {
+				break
+			}
+			flush()
+			if err := st.Maintain(time.Now()); err != nil {
+				logger.Errorf("Maintain(): %s\n", err.Error())
+			}
+		}
+	}
+}
@@ -0,0 +1,284 @@
+/*
+	Copyright (c) 2016 Christopher Young
+	Distributable under the terms of The "BSD New"" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	storage_flatfile.go: Append-only flat file storage backend. One JSON record per line;
+		queries scan the file. Pure Go, for builds without cgo. RawRetentionDays is applied
+		by rewriting the file without the old samples, at most once per FLATFILE_PRUNE_SLACK.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	FLATFILE_DEFAULT_PATH = "./flowfast.jsonl"
+	FLATFILE_PRUNE_SLACK  = 24 * time.Hour // Rewrite once the oldest sample is this far past the retention cutoff.
+
+	FLATFILE_RECORD_SAMPLE      = "sample"
+	FLATFILE_RECORD_SESSION     = "session"
+	FLATFILE_RECORD_CALIBRATION = "calibration"
+)
+
+type flatfileRecord struct {
+	Type string
+
+	// FLATFILE_RECORD_SAMPLE.
+	StartNs int64   `json:",omitempty"`
+	EndNs   int64   `json:",omitempty"`
+	Pulses  uint64  `json:",omitempty"`
+	KFactor float64 `json:",omitempty"`
+	Gallons float64 `json:",omitempty"`
+
+	Session     *sessionSummary `json:",omitempty"`
+	Calibration *calibration    `json:",omitempty"`
+}
+
+type flatfileStorage struct {
+	path     string
+	fp       *os.File
+	readOnly bool
+	mu       *sync.Mutex
+}
+
+func init() {
+	storageBackends["flatfile"] = openFlatfileStorage
+	storageReaders["flatfile"] = openFlatfileStorageReadOnly
+}
+
+func openFlatfileStorage(path string) (storage, error) {
+	fp, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &flatfileStorage{path: path, fp: fp, mu: &sync.Mutex{}}, nil
+}
+
+func openFlatfileStorageReadOnly(path string) (storage, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &flatfileStorage{path: path, fp: fp, readOnly: true, mu: &sync.Mutex{}}, nil
+}
+
+// Append records and fsync.
+func (s *flatfileStorage) append(recs []flatfileRecord) error {
+	if s.readOnly {
+		return errStorageReadOnly
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for i := range recs {
+		if err := enc.Encode(&recs[i]); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.fp.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	return s.fp.Sync()
+}
+
+// Call fn for each record in the file. Lines that don't parse (a torn last write) are skipped.
+func (s *flatfileStorage) scan(fn func(*flatfileRecord) error) error {
+	s.mu.Lock()
+	fp, err := os.Open(s.path)
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	sc := bufio.NewScanner(fp)
+	for sc.Scan() {
+		var r flatfileRecord
+		if json.Unmarshal(sc.Bytes(), &r) != nil {
+			continue
+		}
+		if err := fn(&r); err != nil {
+			return err
+		}
+	}
+	return sc.Err()
+}
+
+func (s *flatfileStorage) AppendSamples(samples []fuel_log) error {
+	recs := make([]flatfileRecord, len(samples))
+	for i, f := range samples {
+		recs[i] = flatfileRecord{
+			Type:    FLATFILE_RECORD_SAMPLE,
+			StartNs: f.log_date_start.UnixNano(),
+			EndNs:   f.log_date_end.UnixNano(),
+			Pulses:  f.pulses,
+			KFactor: f.k_factor,
+			Gallons: f.flow,
+		}
+	}
+	return s.append(recs)
+}
+
+func (s *flatfileStorage) AppendSession(sum sessionSummary) error {
+	return s.append([]flatfileRecord{{Type: FLATFILE_RECORD_SESSION, Session: &sum}})
+}
+
+func (s *flatfileStorage) AppendCalibration(c calibration) error {
+	return s.append([]flatfileRecord{{Type: FLATFILE_RECORD_CALIBRATION, Calibration: &c}})
+}
+
+func (s *flatfileStorage) QuerySamples(from, to time.Time, fn func(fuel_log) error) error {
+	fromNs, toNs := from.UnixNano(), to.UnixNano()
+	return s.scan(func(r *flatfileRecord) error {
+		if r.Type != FLATFILE_RECORD_SAMPLE || r.StartNs < fromNs || r.StartNs >= toNs {
+			return nil
+		}
+		return fn(fuel_log{
+			log_date_start: time.Unix(0, r.StartNs),
+			log_date_end:   time.Unix(0, r.EndNs),
+			flow:           r.Gallons,
+			pulses:         r.Pulses,
+			k_factor:       r.KFactor,
+		})
+	})
+}
+
+func (s *flatfileStorage) QuerySessions(from, to time.Time, fn func(sessionSummary) error) error {
+	return s.scan(func(r *flatfileRecord) error {
+		if r.Type != FLATFILE_RECORD_SESSION || r.Session == nil || r.Session.Start.Before(from) || !r.Session.Start.Before(to) {
+			return nil
+		}
+		return fn(*r.Session)
+	})
+}
+
+func (s *flatfileStorage) LatestCalibration() (calibration, bool, error) {
+	var c calibration
+	found := false
+	err := s.scan(func(r *flatfileRecord) error {
+		if r.Type == FLATFILE_RECORD_CALIBRATION && r.Calibration != nil {
+			c = *r.Calibration
+			found = true
+		}
+		return nil
+	})
+	return c, found, err
+}
+
+func (s *flatfileStorage) History(since, now time.Time) ([]historyPoint, error) {
+	return bucketSamples(s, since, now)
+}
+
+// Apply RawRetentionDays, there are no rollups to keep. Sessions and calibrations stay.
+func (s *flatfileStorage) Maintain(now time.Time) error {
+	if s.readOnly {
+		return errStorageReadOnly
+	}
+	cutoff := rawRetentionCutoff(now)
+	if cutoff == 0 {
+		return nil
+	}
+	cutoffNs := time.Unix(cutoff, 0).UnixNano()
+
+	// Samples are appended in time order, so the first one is the oldest.
+	oldest := int64(0)
+	err := s.scan(func(r *flatfileRecord) error {
+		if r.Type == FLATFILE_RECORD_SAMPLE {
+			oldest = r.StartNs
+			return errFlatfileScanStop
+		}
+		return nil
+	})
+	if err != nil && err != errFlatfileScanStop {
+		return err
+	}
+	if oldest == 0 || oldest >= cutoffNs-int64(FLATFILE_PRUNE_SLACK) {
+		return nil
+	}
+	return s.prune(cutoffNs)
+}
+
+var errFlatfileScanStop = errors.New("stop")
+
+// Rewrite the file without samples starting before cutoffNs, and swap it in.
+func (s *flatfileStorage) prune(cutoffNs int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tmp := s.path + ".tmp"
+	in, err := os.Open(s.path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	// Stays open as the new file once renamed.
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_RDWR|os.O_TRUNC|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(out)
+	sc := bufio.NewScanner(in)
+	dropped := 0
+	for sc.Scan() {
+		var r flatfileRecord
+		if json.Unmarshal(sc.Bytes(), &r) != nil {
+			continue // Torn write, drop it while we're here.
+		}
+		if r.Type == FLATFILE_RECORD_SAMPLE && r.StartNs < cutoffNs {
+			dropped++
+			continue
+		}
+		w.Write(sc.Bytes())
+		w.WriteByte('\n')
+	}
+	if err := sc.Err(); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+	s.fp.Close()
+	s.fp = out
+	logger.Debugf("pruned %d raw samples.\n", dropped)
+	return nil
+}
+
+func (s *flatfileStorage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.readOnly {
+		return s.fp.Close()
+	}
+	if err := s.fp.Sync(); err != nil {
+		s.fp.Close()
+		return err
+	}
+	return s.fp.Close()
+}
@@ -0,0 +1,108 @@
+/*
+	Copyright (c) 2016 Christopher Young
+	Distributable under the terms of The "BSD New"" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	storage_flatfile_test.go: Flat file retention and the read-only open used by export.
+*/
+
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func flatfileSampleTimes(t *testing.T, st storage) []time.Time {
+	var ret []time.Time
+	err := st.QuerySamples(time.Unix(0, 0), time.Now().Add(time.Hour), func(f fuel_log) error {
+		ret = append(ret, f.log_date_start)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ret
+}
+
+func TestFlatfileRetention(t *testing.T) {
+	globalSettings.RawRetentionDays = 30
+	defer func() { globalSettings.RawRetentionDays = 30 }()
+
+	path := filepath.Join(t.TempDir(), "flowfast.jsonl")
+	st, err := openStorage("flatfile", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+
+	now := time.Now()
+	days := []int{40, 32, 29, 1}
+	for _, d := range days {
+		start := now.Add(-time.Duration(d) * 24 * time.Hour)
+		if err := st.AppendSamples([]fuel_log{{log_date_start: start, log_date_end: start.Add(time.Second), pulses: 1, k_factor: 68000}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := st.AppendCalibration(calibration{Time: now.Add(-35 * 24 * time.Hour), KFactor: 68000}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := st.Maintain(now); err != nil {
+		t.Fatal(err)
+	}
+	if got := flatfileSampleTimes(t, st); len(got) != 2 {
+		t.Fatalf("%d samples after pruning, want 2", len(got))
+	}
+	if _, ok, err := st.LatestCalibration(); !ok || err != nil {
+		t.Errorf("calibration pruned: %v", err)
+	}
+
+	// Appends go to the rewritten file.
+	if err := st.AppendSamples([]fuel_log{{log_date_start: now, log_date_end: now.Add(time.Second), pulses: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if got := flatfileSampleTimes(t, st); len(got) != 3 {
+		t.Errorf("%d samples after append, want 3", len(got))
+	}
+
+	// Nothing past the cutoff by more than FLATFILE_PRUNE_SLACK: no rewrite, nothing dropped.
+	if err := st.Maintain(now.Add(12 * time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if got := flatfileSampleTimes(t, st); len(got) != 3 {
+		t.Errorf("%d samples within the slack, want 3", len(got))
+	}
+}
+
+func TestFlatfileReadOnly(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "flowfast.jsonl")
+	if _, err := openStorageReadOnly("flatfile", path); err == nil {
+		t.Error("read-only open created a missing file")
+	}
+
+	st, err := openStorage("flatfile", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	st.AppendSamples([]fuel_log{{log_date_start: now, log_date_end: now.Add(time.Second), pulses: 1}})
+	st.Close()
+
+	ro, err := openStorageReadOnly("flatfile", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ro.Close()
+	if got := flatfileSampleTimes(t, ro); len(got) != 1 {
+		t.Errorf("%d samples read, want 1", len(got))
+	}
+	if err := ro.AppendSamples([]fuel_log{{log_date_start: now}}); err != errStorageReadOnly {
+		t.Errorf("append on read-only: %v", err)
+	}
+	if err := ro.Maintain(now); err != errStorageReadOnly {
+		t.Errorf("maintain on read-only: %v", err)
+	}
+}
@@ -0,0 +1,115 @@
+/*
+	Copyright (c) 2016 Christopher Young
+	Distributable under the terms of The "BSD New"" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	storage_memory.go: In-memory storage backend. Nothing survives a restart.
+*/
+
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+type memoryStorage struct {
+	samples      []fuel_log
+	sessions     []sessionSummary
+	calibrations []calibration
+	mu           *sync.Mutex
+}
+
+func init() {
+	storageBackends["memory"] = func(path string) (storage, error) {
+		return &memoryStorage{mu: &sync.Mutex{}}, nil
+	}
+	storageReaders["memory"] = storageBackends["memory"] // Nothing shared to protect.
+}
+
+func (m *memoryStorage) AppendSamples(samples []fuel_log) error {
+	m.mu.Lock()
+	m.samples = append(m.samples, samples...)
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *memoryStorage) AppendSession(s sessionSummary) error {
+	m.mu.Lock()
+	m.sessions = append(m.sessions, s)
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *memoryStorage) AppendCalibration(c calibration) error {
+	m.mu.Lock()
+	m.calibrations = append(m.calibrations, c)
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *memoryStorage) QuerySamples(from, to time.Time, fn func(fuel_log) error) error {
+	m.mu.Lock()
+	// Samples are appended in time order.
+	i := sort.Search(len(m.samples), func(i int) bool { return !m.samples[i].log_date_start.Before(from) })
+	j := sort.Search(len(m.samples), func(i int) bool { return !m.samples[i].log_date_start.Before(to) })
+	sel := append([]fuel_log(nil), m.samples[i:j]...)
+	m.mu.Unlock()
+
+	for _, f := range sel {
+		if err := fn(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *memoryStorage) QuerySessions(from, to time.Time, fn func(sessionSummary) error) error {
+	m.mu.Lock()
+	sel := make([]sessionSummary, 0)
+	for _, s := range m.sessions {
+		if !s.Start.Before(from) && s.Start.Before(to) {
+			sel = append(sel, s)
+		}
+	}
+	m.mu.Unlock()
+
+	for _, s := range sel {
+		if err := fn(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *memoryStorage) LatestCalibration() (calibration, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.calibrations) == 0 {
+		return calibration{}, false, nil
+	}
+	return m.calibrations[len(m.calibrations)-1], true, nil
+}
+
+func (m *memoryStorage) History(since, now time.Time) ([]historyPoint, error) {
+	return bucketSamples(m, since, now)
+}
+
+// Apply RawRetentionDays, there are no rollups to keep.
+func (m *memoryStorage) Maintain(now time.Time) error {
+	cutoff := rawRetentionCutoff(now)
+	if cutoff == 0 {
+		return nil
+	}
+	m.mu.Lock()
+	i := sort.Search(len(m.samples), func(i int) bool { return m.samples[i].log_date_start.Unix() >= cutoff })
+	m.samples = append([]fuel_log(nil), m.samples[i:]...)
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *memoryStorage) Close() error {
+	return nil
+}
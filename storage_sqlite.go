@@ -0,0 +1,240 @@
+//go:build cgo
+// +build cgo
+
+/*
+	Copyright (c) 2016 Christopher Young
+	Distributable under the terms of The "BSD New"" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	storage_sqlite.go: SQLite storage backend. go-sqlite3 needs cgo, so this backend is only
+		built with cgo enabled.
+*/
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	_ "github.com/mattn/go-sqlite3"
+	"time"
+)
+
+type sqliteStorage struct {
+	db         *sql.DB
+	insertStmt *sql.Stmt // nil if read-only.
+}
+
+func init() {
+	storageBackends["sqlite"] = openSQLiteStorage
+	storageReaders["sqlite"] = openSQLiteStorageReadOnly
+}
+
+// Open without touching the file: no WAL switch, migrations or checkpoint on Close. The schema
+// has to be current already, the daemon migrates it.
+func openSQLiteStorageReadOnly(path string) (storage, error) {
+	db, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		return nil, err
+	}
+	migrations, err := loadMigrations()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	v, err := schemaVersion(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	if v != len(migrations) {
+		db.Close()
+		return nil, fmt.Errorf("database schema version %d, this build reads %d (start the daemon to migrate it)", v, len(migrations))
+	}
+	return &sqliteStorage{db: db}, nil
+}
+
+func openSQLiteStorage(path string) (storage, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+
+	// WAL: appends only touch the log, and a torn write on power loss can't corrupt the main file.
+	if _, err := db.Exec("PRAGMA journal_mode=WAL"); err != nil {
+		logger.Errorf("PRAGMA journal_mode: %s\n", err.Error())
+	}
+
+	if err := migrateDB(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	insertStmt, err := db.Prepare("INSERT INTO fuel_flow(log_date_start, log_date_end, flow, log_start_ns, log_end_ns, pulses, k_factor) VALUES (?, ?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &sqliteStorage{db: db, insertStmt: insertStmt}, nil
+}
+
+// Write a batch of rows in a single transaction.
+func (s *sqliteStorage) AppendSamples(samples []fuel_log) error {
+	if s.insertStmt == nil {
+		return errStorageReadOnly
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	stmt := tx.Stmt(s.insertStmt)
+	defer stmt.Close()
+
+	for _, f := range samples {
+		if _, err := stmt.Exec(f.log_date_start.Unix(), f.log_date_end.Unix(), f.flow,
+			f.log_date_start.UnixNano(), f.log_date_end.UnixNano(), int64(f.pulses), f.k_factor); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteStorage) AppendSession(sum sessionSummary) error {
+	if s.insertStmt == nil {
+		return errStorageReadOnly
+	}
+	_, err := s.db.Exec("INSERT INTO sessions(start_ns, end_ns, pulses, fuel_used, avg_gph, max_gph) VALUES (?, ?, ?, ?, ?, ?)",
+		sum.Start.UnixNano(), sum.End.UnixNano(), int64(sum.Pulses), sum.Fuel_Used, sum.Avg_GPH, sum.Max_GPH)
+	return err
+}
+
+func (s *sqliteStorage) AppendCalibration(c calibration) error {
+	if s.insertStmt == nil {
+		return errStorageReadOnly
+	}
+	_, err := s.db.Exec("INSERT INTO calibration(time_ns, k_factor, note) VALUES (?, ?, ?)", c.Time.UnixNano(), c.KFactor, c.Note)
+	return err
+}
+
+func (s *sqliteStorage) QuerySamples(from, to time.Time, fn func(fuel_log) error) error {
+	rows, err := s.db.Query("SELECT log_start_ns, log_end_ns, pulses, k_factor, flow FROM fuel_flow WHERE log_start_ns >= ? AND log_start_ns < ? ORDER BY log_start_ns",
+		from.UnixNano(), to.UnixNano())
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var startNs, endNs, pulses int64
+		var f fuel_log
+		if err := rows.Scan(&startNs, &endNs, &pulses, &f.k_factor, &f.flow); err != nil {
+			return err
+		}
+		f.log_date_start = time.Unix(0, startNs)
+		f.log_date_end = time.Unix(0, endNs)
+		f.pulses = uint64(pulses)
+		if err := fn(f); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (s *sqliteStorage) QuerySessions(from, to time.Time, fn func(sessionSummary) error) error {
+	rows, err := s.db.Query("SELECT start_ns, end_ns, pulses, fuel_used, avg_gph, max_gph FROM sessions WHERE start_ns >= ? AND start_ns < ? ORDER BY start_ns",
+		from.UnixNano(), to.UnixNano())
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var startNs, endNs, pulses int64
+		var sum sessionSummary
+		if err := rows.Scan(&startNs, &endNs, &pulses, &sum.Fuel_Used, &sum.Avg_GPH, &sum.Max_GPH); err != nil {
+			return err
+		}
+		sum.Start = time.Unix(0, startNs)
+		sum.End = time.Unix(0, endNs)
+		sum.Pulses = uint64(pulses)
+		if err := fn(sum); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (s *sqliteStorage) LatestCalibration() (calibration, bool, error) {
+	var c calibration
+	var ns int64
+	err := s.db.QueryRow("SELECT time_ns, k_factor, note FROM calibration ORDER BY time_ns DESC LIMIT 1").Scan(&ns, &c.KFactor, &c.Note)
+	if err == sql.ErrNoRows {
+		return c, false, nil
+	}
+	if err != nil {
+		return c, false, err
+	}
+	c.Time = time.Unix(0, ns)
+	return c, true, nil
+}
+
+// Per-minute for short ranges, per-hour from the hour rollup beyond HISTORY_MINUTE_MAX. Minutes
+// before the newest rolled-up one come from the minute rollup, since their raw rows may have been
+// pruned. From there on they're summed from the raw rows, which dbPrune() keeps, so the current
+// minute shows up.
+func (s *sqliteStorage) History(since, now time.Time) ([]historyPoint, error) {
+	q := `SELECT minute, flow FROM fuel_flow_minute
+		WHERE minute >= ? AND minute < (SELECT IFNULL(MAX(minute), 0) FROM fuel_flow_minute)
+		UNION ALL
+		SELECT (log_date_start / 60) * 60 AS m, SUM(flow) FROM fuel_flow
+		WHERE log_date_start >= ? AND log_date_start >= (SELECT IFNULL(MAX(minute), 0) FROM fuel_flow_minute)
+		GROUP BY m ORDER BY 1`
+	args := []interface{}{since.Unix(), since.Unix()}
+	bucketSecs := float64(60.0)
+	if now.Sub(since) > HISTORY_MINUTE_MAX*time.Minute {
+		q = "SELECT hour, flow FROM fuel_flow_hour WHERE hour >= ? ORDER BY hour"
+		args = args[:1]
+		bucketSecs = float64(3600.0)
+	}
+
+	rows, err := s.db.Query(q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ret := make([]historyPoint, 0)
+	for rows.Next() {
+		var p historyPoint
+		var gallons float64
+		if err := rows.Scan(&p.Time, &gallons); err != nil {
+			return nil, err
+		}
+		p.GPH = gallons * float64(3600.0) / bucketSecs
+		ret = append(ret, p)
+	}
+	return ret, rows.Err()
+}
+
+func (s *sqliteStorage) Maintain(now time.Time) error {
+	if s.insertStmt == nil {
+		return errStorageReadOnly
+	}
+	if err := dbRollup(s.db, now); err != nil {
+		return err
+	}
+	return dbPrune(s.db, now)
+}
+
+// Fold the WAL back into the database so the file is complete on its own.
+func (s *sqliteStorage) Close() error {
+	if s.insertStmt == nil {
+		return s.db.Close()
+	}
+	s.insertStmt.Close()
+	if _, err := s.db.Exec("PRAGMA wal_checkpoint(TRUNCATE)"); err != nil {
+		logger.Errorf("PRAGMA wal_checkpoint: %s\n", err.Error())
+	}
+	return s.db.Close()
+}
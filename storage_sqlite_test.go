@@ -0,0 +1,156 @@
+//go:build cgo
+// +build cgo
+
+/*
+	Copyright (c) 2016 Christopher Young
+	Distributable under the terms of The "BSD New"" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	storage_sqlite_test.go: Read-only SQLite open used by export, and the append benchmark against
+		the write path from before batching.
+*/
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSQLiteReadOnly(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "flowfast.db")
+	st, err := openStorage("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	if err := st.AppendSamples([]fuel_log{{log_date_start: now, log_date_end: now.Add(time.Second), pulses: 3, k_factor: 68000}}); err != nil {
+		t.Fatal(err)
+	}
+	st.Close()
+	before, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ro, err := openStorageReadOnly("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	if err := ro.QuerySamples(now.Add(-time.Second), now.Add(time.Second), func(fuel_log) error { n++; return nil }); err != nil || n != 1 {
+		t.Errorf("query: %d rows, %v", n, err)
+	}
+	if err := ro.AppendSamples([]fuel_log{{log_date_start: now}}); err != errStorageReadOnly {
+		t.Errorf("append on read-only: %v", err)
+	}
+	if err := ro.Maintain(now); err != errStorageReadOnly {
+		t.Errorf("maintain on read-only: %v", err)
+	}
+	if err := ro.Close(); err != nil {
+		t.Error(err)
+	}
+	// The daemon's file is untouched: no migration, no checkpoint.
+	if after, err := os.Stat(path); err != nil || after.Size() != before.Size() || !after.ModTime().Equal(before.ModTime()) {
+		t.Errorf("read-only open modified the database: %v", err)
+	}
+
+	// A database the daemon hasn't migrated yet is refused, not migrated.
+	old := filepath.Join(t.TempDir(), "old.db")
+	db, err := sql.Open("sqlite3", old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Exec("CREATE TABLE fuel_flow (log_date_start INTEGER, log_date_end INTEGER, flow REAL)")
+	db.Close()
+	if _, err := openStorageReadOnly("sqlite", old); err == nil {
+		t.Error("read-only open of an unmigrated database succeeded")
+	}
+}
+
+// Bytes added to the database file and its WAL since before.
+func sqliteGrowth(path string, before [2]int64) (db, wal int64) {
+	var sizes [2]int64
+	for i, p := range []string{path, path + "-wal"} {
+		if fi, err := os.Stat(p); err == nil {
+			sizes[i] = fi.Size()
+		}
+	}
+	return sizes[0] - before[0], sizes[1] - before[1]
+}
+
+// A minute of samples per op: committed as one batch, one transaction per sample, and as the daemon
+// wrote them before batching (an autocommit fmt.Sprintf INSERT per sample, no WAL). Also reports how
+// much the database and WAL files grow per sample. On an SD card the gap is far wider than on a
+// build machine's disk.
+func BenchmarkSQLiteAppend(b *testing.B) {
+	const samples = 60
+	for _, bc := range []struct {
+		name  string
+		batch int // 0 for the pre-batching path.
+	}{{"batched", samples}, {"per-sample", 1}, {"autocommit-sprintf", 0}} {
+		b.Run(bc.name, func(b *testing.B) {
+			path := filepath.Join(b.TempDir(), "flowfast.db")
+			var appendMinute func(batch []fuel_log) error
+			if bc.batch > 0 {
+				st, err := openStorage("sqlite", path)
+				if err != nil {
+					b.Fatal(err)
+				}
+				defer st.Close()
+				appendMinute = func(batch []fuel_log) error {
+					for j := 0; j < len(batch); j += bc.batch {
+						if err := st.AppendSamples(batch[j : j+bc.batch]); err != nil {
+							return err
+						}
+					}
+					return nil
+				}
+			} else {
+				db, err := sql.Open("sqlite3", path)
+				if err != nil {
+					b.Fatal(err)
+				}
+				defer db.Close()
+				if _, err := db.Exec("CREATE TABLE fuel_flow (id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT, log_date_start INTEGER, log_date_end INTEGER, flow REAL)"); err != nil {
+					b.Fatal(err)
+				}
+				appendMinute = func(batch []fuel_log) error {
+					for _, f := range batch {
+						q := fmt.Sprintf("INSERT INTO fuel_flow(log_date_start, log_date_end, flow) values(%d, %d, %f)", f.log_date_start.Unix(), f.log_date_end.Unix(), f.flow)
+						if _, err := db.Exec(q); err != nil {
+							return err
+						}
+					}
+					return nil
+				}
+			}
+
+			var before [2]int64
+			before[0], before[1] = sqliteGrowth(path, before)
+			t0 := time.Now()
+			batch := make([]fuel_log, samples)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for j := range batch {
+					t := t0.Add(time.Duration(i*samples+j) * time.Second)
+					batch[j] = fuel_log{log_date_start: t, log_date_end: t.Add(time.Second), flow: 0.002, pulses: 136, k_factor: 68000}
+				}
+				if err := appendMinute(batch); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.StopTimer()
+			n := float64(b.N * samples)
+			db, wal := sqliteGrowth(path, before)
+			b.ReportMetric(float64(b.Elapsed().Microseconds())/n, "us/sample")
+			b.ReportMetric(float64(db)/n, "db-B/sample")
+			b.ReportMetric(float64(wal)/n, "wal-B/sample")
+		})
+	}
+}
@@ -0,0 +1,173 @@
+/*
+	Copyright (c) 2016 Christopher Young
+	Distributable under the terms of The "BSD New"" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	storage_test.go: storageLogger() keeps draining logChan into the journal while the backend
+		can't be opened, and stores everything once it can.
+*/
+
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStorageLoggerRetriesOpen(t *testing.T) {
+	savedSettings, savedLogChan, savedJournal, savedDelay := globalSettings, logChan, journal, storageReopenDelay
+	defer func() {
+		globalSettings, logChan, journal, storageReopenDelay = savedSettings, savedLogChan, savedJournal, savedDelay
+	}()
+
+	var mu sync.Mutex
+	fails := 1
+	var opened *memoryStorage
+	reopened := make(chan struct{})
+	storageBackends["flaky"] = func(path string) (storage, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if fails > 0 {
+			fails--
+			return nil, errors.New("not mounted")
+		}
+		opened = &memoryStorage{mu: &sync.Mutex{}}
+		close(reopened)
+		return opened, nil
+	}
+	defer delete(storageBackends, "flaky")
+
+	defaultSettings()
+	globalSettings.StorageBackend = "flaky"
+	storageReopenDelay = 100 * time.Millisecond
+
+	path := filepath.Join(t.TempDir(), "flowfast.journal")
+	j, _, _, _, err := openJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	journal = j
+	logChan = make(chan fuel_log, 8) // Smaller than the samples sent: must keep draining.
+
+	done := make(chan struct{})
+	go func() {
+		storageLogger(nil, 10)
+		close(done)
+	}()
+
+	t0 := time.Unix(1700000000, 0)
+	const n = 20
+	for i := 0; i < n; i++ {
+		select {
+		case logChan <- fuel_log{log_date_start: t0.Add(time.Duration(i) * time.Second), log_date_end: t0.Add(time.Duration(i+1) * time.Second), pulses: 1, fuel_remaining: 10}:
+		case <-time.After(500 * time.Millisecond):
+			t.Fatalf("logChan blocked at sample %d with storage closed", i)
+		}
+	}
+
+	// Retried after storageReopenDelay, then flushed on shutdown.
+	select {
+	case <-reopened:
+	case <-time.After(5 * time.Second):
+		t.Fatal("storage never reopened")
+	}
+	close(logChan)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("storageLogger didn't return")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if got := len(opened.samples); got != n {
+		t.Errorf("stored %d samples, want %d", got, n)
+	}
+	if _, replay, _, _, err := openJournal(path); err != nil || len(replay) != 0 {
+		t.Errorf("journal after store: %d samples, %v", len(replay), err)
+	}
+}
+
+// Handlers see the store only while it's open, and clearing it waits for the ones using it.
+func TestWithFuelStore(t *testing.T) {
+	defer setFuelStore(nil)
+	if ok, _ := withFuelStore(func(storage) error { return nil }); ok {
+		t.Fatal("store open before setFuelStore()")
+	}
+	setFuelStore(&memoryStorage{mu: &sync.Mutex{}})
+
+	using := make(chan struct{})
+	release := make(chan struct{})
+	go withFuelStore(func(storage) error {
+		close(using)
+		<-release
+		return nil
+	})
+	<-using
+	cleared := make(chan struct{})
+	go func() {
+		setFuelStore(nil)
+		close(cleared)
+	}()
+	select {
+	case <-cleared:
+		t.Fatal("store cleared while a handler was using it")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	<-cleared
+	if ok, _ := withFuelStore(func(storage) error { return nil }); ok {
+		t.Error("store still available after clearing")
+	}
+}
+
+// Rejects every sample write.
+type failingStorage struct {
+	*memoryStorage
+}
+
+func (failingStorage) AppendSamples(samples []fuel_log) error {
+	return errors.New("disk full")
+}
+
+// Samples dropped after failed appends stay in the journal: no checkpoint wipes them.
+func TestStorageLoggerKeepsDroppedInJournal(t *testing.T) {
+	savedSettings, savedLogChan, savedJournal := globalSettings, logChan, journal
+	defer func() { globalSettings, logChan, journal = savedSettings, savedLogChan, savedJournal }()
+
+	storageBackends["failing"] = func(path string) (storage, error) {
+		return failingStorage{&memoryStorage{mu: &sync.Mutex{}}}, nil
+	}
+	defer delete(storageBackends, "failing")
+	defaultSettings()
+	globalSettings.StorageBackend = "failing"
+
+	path := filepath.Join(t.TempDir(), "flowfast.journal")
+	j, _, _, _, err := openJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	journal = j
+	logChan = make(chan fuel_log, 64)
+
+	done := make(chan struct{})
+	go func() {
+		storageLogger(nil, 10)
+		close(done)
+	}()
+	t0 := time.Unix(1700000000, 0)
+	const n = SAMPLE_BATCH_KEEP_MAX + SAMPLE_BATCH_MAX
+	for i := 0; i < n; i++ {
+		logChan <- fuel_log{log_date_start: t0.Add(time.Duration(i) * time.Second), log_date_end: t0.Add(time.Duration(i+1) * time.Second), pulses: 1, fuel_remaining: 10}
+	}
+	close(logChan)
+	<-done
+
+	if _, replay, _, _, err := openJournal(path); err != nil || len(replay) != n {
+		t.Errorf("journal holds %d of %d unstored samples, %v", len(replay), n, err)
+	}
+}
@@ -0,0 +1,85 @@
+/*
+	Copyright (c) 2016 Christopher Young
+	Distributable under the terms of The "BSD New"" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	supply.go: Supply voltage monitor on a spare ADS1115 input. When the supply sags below
+		SupplyMonitorLowVolts (master switch off, failing regulator) storage is flushed and the
+		totalizer checkpointed while the Pi still has power to do it.
+*/
+
+package main
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	SUPPLY_HYSTERESIS_VOLTS = 0.2 // Re-arm once the supply is this far above the threshold.
+)
+
+type voltageSource interface {
+	readVolts() (float64, error)
+}
+
+// Single-ended reading of one ADS1115 input, scaled by the divider ratio. Borrows the flow input's
+// ADC and puts the mux back afterwards; the flow loop misses a few ms of samples per reading.
+type adsSupplySource struct {
+	adc     *ads1115
+	channel int
+	scale   float64
+}
+
+func (s *adsSupplySource) readVolts() (float64, error) {
+	v, err := s.adc.readMux(adsMuxSingle(s.channel))
+	if err != nil {
+		return 0, err
+	}
+	return s.adc.config().Gain.millivolts(v) / float64(1000.0) * s.scale, nil
+}
+
+type supplyMonitor struct {
+	src      voltageSource
+	lowVolts float64
+	low      bool
+}
+
+// Take one reading. Requests an emergency flush when the supply first drops below lowVolts.
+func (m *supplyMonitor) poll() error {
+	v, err := m.src.readVolts()
+	if err != nil {
+		return err
+	}
+
+	flow.mu.Lock()
+	flow.Supply_Volts = v
+	flow.mu.Unlock()
+
+	switch {
+	case !m.low && v < m.lowVolts:
+		m.low = true
+		logger.Errorf("supply %0.2fV below %0.2fV, flushing storage.\n", v, m.lowVolts)
+		requestEmergencyFlush()
+	case m.low && v >= m.lowVolts+SUPPLY_HYSTERESIS_VOLTS:
+		m.low = false
+		logger.Warningf("supply back to %0.2fV.\n", v)
+	}
+	return nil
+}
+
+func (m *supplyMonitor) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := m.poll(); err != nil {
+			logger.Errorf("supply monitor: %s\n", err.Error())
+		}
+	}
+}
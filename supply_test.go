@@ -0,0 +1,118 @@
+/*
+	Copyright (c) 2016 Christopher Young
+	Distributable under the terms of The "BSD New"" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	supply_test.go: Supply monitor low threshold, flush request and re-arm.
+*/
+
+package main
+
+import (
+	"errors"
+	"sync"
+	"testing"
+)
+
+// Steps through a fixed list of readings, then keeps returning the last one.
+type fakeVoltageSource struct {
+	volts []float64
+	i     int
+	err   error
+}
+
+func (s *fakeVoltageSource) readVolts() (float64, error) {
+	if s.err != nil {
+		return 0, s.err
+	}
+	v := s.volts[s.i]
+	if s.i < len(s.volts)-1 {
+		s.i++
+	}
+	return v, nil
+}
+
+func emergencyFlushRequested() bool {
+	select {
+	case <-emergencyFlushChan:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestSupplyMonitorPoll(t *testing.T) {
+	if flow.mu == nil {
+		flow.mu = &sync.Mutex{} // Set up by main().
+	}
+	emergencyFlushRequested()
+	src := &fakeVoltageSource{}
+	m := &supplyMonitor{src: src, lowVolts: 11.0}
+	tests := []struct {
+		volts float64
+		flush bool
+		low   bool
+	}{
+		{13.8, false, false},
+		{11.0, false, false}, // At the threshold isn't below it.
+		{10.9, true, true},
+		{9.0, false, true},   // One flush per drop.
+		{11.1, false, true},  // Above the threshold, within the hysteresis.
+		{10.5, false, true},  // Still the same drop.
+		{11.19, false, true}, // Just short of re-arming.
+		{11.2, false, false}, // Re-armed.
+		{10.99, true, true},  // A new drop flushes again.
+		{14.0, false, false},
+	}
+	for i, tt := range tests {
+		src.volts = append(src.volts[:0], tt.volts)
+		src.i = 0
+		if err := m.poll(); err != nil {
+			t.Fatal(err)
+		}
+		if flushed := emergencyFlushRequested(); flushed != tt.flush {
+			t.Errorf("step %d, %0.2fV: flush %v, want %v", i, tt.volts, flushed, tt.flush)
+		}
+		if m.low != tt.low {
+			t.Errorf("step %d, %0.2fV: low %v, want %v", i, tt.volts, m.low, tt.low)
+		}
+		flow.mu.Lock()
+		v := flow.Supply_Volts
+		flow.mu.Unlock()
+		if v != tt.volts {
+			t.Errorf("step %d: Supply_Volts %0.2f, want %0.2f", i, v, tt.volts)
+		}
+	}
+
+	src.err = errors.New("no reading")
+	if err := m.poll(); err == nil {
+		t.Error("read error not returned")
+	}
+	if emergencyFlushRequested() || m.low {
+		t.Error("read error changed the monitor state")
+	}
+}
+
+// Channel 3 through a 4:1 divider on the flow ADC, at +/-4.096V.
+func TestADSSupplySource(t *testing.T) {
+	bus := newFakeI2CBus(func(addr byte, cfg uint16) uint16 {
+		if parseADSConfig(cfg).Mux == ADS_MUX_P3_NG {
+			return 24000 // 3000 mV.
+		}
+		return 0
+	}, ADS_ADDR_MIN)
+	d, _ := newADS1115(bus, ADS_ADDR_MIN)
+	cfg := adsFlowConfig
+	cfg.Gain = ADS_PGA_4096
+	if err := d.configure(cfg); err != nil {
+		t.Fatal(err)
+	}
+	src := &adsSupplySource{adc: d, channel: 3, scale: 4}
+	if v, err := src.readVolts(); err != nil || v != 12.0 {
+		t.Errorf("readVolts() = %g, %v, want 12", v, err)
+	}
+	if d.config() != cfg {
+		t.Errorf("flow config not restored: %+v", d.config())
+	}
+}
@@ -1,12 +0,0 @@
-package main
-
-import (
-	"fmt"
-)
-
-func main() {
-	f := []float64{659.437500, 658.125000, 658.125000, 1248.000000, 832.875000, 658.312500, 658.125000, 1040.437500, 658.312500, 677.062500, 658.312500, 657.937500, 1386.562500, 1005.562500, 658.875000, 658.125000, 658.125000, 657.562500, 1317.187500, 936.375000, 658.500000, 658.125000, 657.937500, 658.125000, 1247.812500, 867.375000, 658.312500, 658.125000, 658.125000, 1161.187500, 763.312500, 658.125000, 657.937500, 658.312500, 971.062500, 658.500000, 658.125000, 658.312500, 658.125000, 1178.625000, 763.312500, 658.125000, 658.125000, 657.750000, 953.625000, 658.312500, 658.312500, 658.312500, 657.937500, 1144.125000, 658.500000, 729.000000, 658.312500, 658.500000, 658.312500, 658.312500, 1351.875000, 657.937500, 658.125000, 658.312500, 658.500000, 658.500000, 658.125000, 657.937500, 658.312500, 658.125000, 1334.625000, 919.312500, 658.687500, 658.312500, 658.312500, 658.125000, 1109.625000, 658.125000, 658.312500, 658.312500, 1317.187500, 954.000000, 658.875000, 658.312500, 658.500000, 1264.875000, 658.312500, 867.375000, 658.875000, 658.312500, 658.500000, 1196.250000, 658.312500, 815.437500, 658.312500, 658.312500, 658.125000, 658.312500, 1142.437500, 763.125000, 658.500000, 658.312500, 1386.562500, 971.250000, 658.125000, 658.312500, 658.312500, 1179.000000, 658.125000, 658.312500, 658.500000, 657.750000, 658.500000, 1369.312500, 936.750000, 658.500000, 659.062500, 658.500000, 658.687500, 1144.125000, 658.125000, 658.500000, 658.312500, 658.312500, 658.500000, 919.687500, 658.500000, 658.500000, 658.500000, 658.500000, 694.312500, 658.312500, 658.687500, 658.500000, 658.500000, 885.000000, 658.687500, 658.125000, 658.687500, 658.687500, 1075.312500, 660.000000, 658.687500, 658.875000, 1283.062500, 850.875000, 658.500000, 658.687500, 658.312500, 658.687500, 658.500000, 1057.875000, 658.500000, 659.812500, 658.312500, 658.500000, 658.687500, 1248.937500, 833.062500, 658.687500, 658.500000, 658.500000, 658.312500, 659.625000, 658.125000, 658.500000, 658.687500, 658.500000, 798.562500, 658.500000, 658.687500, 1421.437500, 658.500000, 659.250000, 658.312500, 658.687500, 658.500000, 658.687500, 658.875000, 658.687500, 1386.937500, 658.500000, 658.500000, 658.500000, 658.687500, 1144.500000, 729.187500, 658.875000, 658.687500, 1352.250000, 919.875000, 659.250000, 658.875000, 658.687500, 1110.187500, 658.500000, 658.875000, 658.875000, 658.875000, 1283.437500, 658.500000, 659.062500, 658.875000, 658.687500, 658.500000, 1072.312500, 660.000000, 659.062500, 658.875000, 1266.187500, 658.687500, 659.062500, 658.875000, 658.687500, 658.687500, 658.687500, 1040.812500, 658.500000, 659.812500, 658.875000, 658.875000, 1248.750000, 658.875000, 659.250000, 658.687500, 658.500000, 658.687500, 659.437500, 658.687500, 658.875000, 1214.062500, 798.937500, 659.062500, 659.062500, 658.875000, 1006.500000, 659.625000, 658.875000, 658.687500, 1214.062500, 781.500000, 658.875000, 658.687500, 1421.437500, 989.250000, 659.625000, 658.687500, 658.687500, 658.500000, 658.875000, 764.250000, 658.875000, 658.687500, 1370.062500, 954.562500, 659.062500, 658.875000, 658.500000, 658.687500, 658.875000, 729.562500, 658.875000, 658.687500, 1318.312500, 658.875000, 659.062500, 659.062500, 658.875000, 658.875000, 1041.375000, 659.812500, 658.687500, 659.062500, 658.875000, 659.062500, 781.500000, 658.875000, 658.875000, 658.875000, 659.062500, 954.750000, 659.437500, 658.875000, 659.062500, 658.687500, 1127.625000, 658.875000, 658.875000, 658.875000, 658.875000, 659.062500, 658.687500, 659.250000, 659.062500, 658.875000, 1022.062500, 659.062500, 658.875000, 659.062500, 1179.562500, 659.062500, 658.875000, 658.875000, 659.062500, 1317.937500, 885.562500, 659.062500, 658.687500, 658.875000, 1042.312500, 659.062500, 660.187500, 659.062500, 659.062500, 658.875000, 1214.250000, 659.250000, 659.062500, 658.875000, 658.875000, 1370.250000, 939.937500, 659.250000, 659.062500, 658.875000, 1110.375000, 659.062500, 660.750000, 659.062500, 659.062500, 659.250000, 833.437500, 659.062500, 658.687500, 1422.000000, 659.062500, 658.875000, 659.625000, 658.875000, 658.875000, 658.875000, 1127.812500, 694.875000, 658.875000, 658.875000, 1283.437500, 851.062500, 659.062500, 658.875000, 659.250000, 658.687500, 1006.687500, 659.625000, 659.062500, 658.687500, 1179.375000, 729.562500, 658.875000, 658.875000, 1318.125000, 888.750000, 659.062500, 659.250000, 659.062500, 658.875000, 1041.375000, 658.875000, 660.187500, 659.062500, 658.875000, 659.250000, 764.250000, 659.250000, 659.250000, 659.062500, 1353.562500, 937.500000, 658.875000, 659.625000, 658.875000, 658.687500, 1093.312500, 661.875000, 659.437500, 659.062500, 659.062500, 659.250000, 833.625000, 659.250000, 659.062500, 659.250000, 972.187500, 659.812500, 659.062500, 659.062500, 1145.250000, 711.937500, 659.250000, 659.062500, 659.062500, 1301.062500, 868.500000, 659.437500, 659.062500, 1007.062500, 659.250000, 660.000000, 659.437500, 659.437500, 659.062500, 1162.687500, 729.937500, 659.437500, 658.875000, 1318.500000, 901.875000, 659.625000, 659.437500, 659.437500, 659.250000, 1041.562500, 659.437500, 659.625000, 659.437500, 659.437500, 659.250000, 659.625000, 659.812500, 659.437500, 659.250000, 1370.437500, 659.437500, 937.875000, 659.625000, 659.250000, 659.250000, 1076.062500, 659.625000, 659.437500, 659.250000, 1249.125000, 799.500000, 659.812500, 659.250000, 659.625000, 972.375000, 659.250000, 659.812500, 659.250000, 659.062500, 659.437500, 695.250000, 659.437500, 659.250000, 659.250000, 659.437500, 937.875000, 659.437500, 659.812500, 659.250000, 659.437500, 1197.000000, 659.250000, 799.125000, 659.625000, 659.062500, 1041.562500, 660.375000, 659.437500, 659.250000, 659.437500, 659.812500, 659.625000, 659.250000, 659.437500, 1162.500000, 659.625000, 659.250000, 659.062500, 1422.375000, 1024.125000, 660.187500, 659.250000, 659.437500, 1249.500000, 799.687500, 659.250000, 659.437500, 1387.875000, 955.125000, 659.625000, 659.437500, 659.250000, 659.812500, 660.562500, 659.250000, 659.437500, 1249.500000, 834.187500, 659.625000, 659.437500, 1422.750000, 972.562500, 660.000000, 659.625000, 659.625000, 659.812500, 712.875000, 659.437500, 659.625000, 659.625000, 659.437500, 659.625000, 659.437500, 1024.687500, 660.000000, 659.625000, 659.625000, 1180.312500, 747.562500, 659.812500, 659.437500, 659.625000, 1336.125000, 903.562500, 659.812500, 659.812500, 659.625000, 659.437500, 659.812500, 660.750000, 659.437500, 659.812500, 659.625000, 764.812500, 659.625000, 659.437500, 659.625000, 659.812500, 659.812500, 660.750000, 659.437500, 659.625000, 659.625000, 1266.750000, 659.625000, 659.437500, 659.437500, 1422.562500, 990.187500, 660.000000, 659.625000, 659.437500, 659.812500, 659.437500, 1145.625000, 659.812500, 659.437500, 659.625000, 1318.687500, 659.812500, 659.625000, 659.625000, 659.437500, 659.625000, 660.375000, 659.250000, 659.437500, 1197.562500, 765.000000, 659.625000, 659.625000, 659.625000, 1353.562500, 920.812500, 659.812500, 659.625000, 659.625000, 1093.875000, 660.937500, 659.625000, 659.437500, 659.625000, 1267.125000, 834.000000, 659.625000, 659.812500, 659.625000, 1422.750000, 659.625000, 660.000000, 659.437500, 659.812500, 659.625000, 712.875000, 659.625000, 660.000000, 1319.062500, 868.875000, 659.812500, 659.812500, 660.000000, 1042.125000, 660.562500, 660.000000, 659.625000, 659.812500, 1197.750000, 765.187500, 660.000000, 659.812500, 660.000000, 1353.750000, 903.937500, 660.187500, 659.812500, 660.000000, 660.000000, 1076.812500, 660.750000, 659.812500, 660.187500, 1215.000000, 659.812500, 660.000000, 659.812500, 659.812500, 1370.625000, 921.000000, 660.187500, 660.000000, 659.812500, 659.625000, 1076.437500, 660.937500, 659.812500, 659.812500, 1232.437500, 799.687500, 660.000000, 659.812500, 659.812500, 1388.250000, 938.437500, 660.000000, 659.812500, 659.812500, 660.000000, 659.812500, 1094.250000, 661.312500, 659.812500, 659.812500, 1239.000000, 659.812500, 799.875000, 659.625000, 660.000000, 1388.437500, 955.875000, 660.375000, 659.812500, 660.187500, 1094.250000, 659.812500, 660.000000, 659.812500, 659.812500, 1249.875000, 800.062500, 660.000000, 659.812500, 1406.062500, 660.187500, 660.375000, 660.000000, 660.187500, 1111.687500, 679.125000, 660.000000, 660.187500, 1250.062500, 826.687500, 660.000000, 660.000000, 660.187500, 1423.312500, 973.312500, 660.750000, 660.000000, 660.187500, 1129.125000, 660.000000, 659.812500, 660.000000, 659.812500, 1267.500000, 834.562500, 660.000000, 660.375000, 660.187500, 1423.312500, 660.187500, 660.000000, 660.750000, 660.000000, 660.187500, 1128.937500, 660.187500, 660.187500, 659.812500, 660.000000, 1284.750000, 660.187500, 869.437500, 660.375000, 660.000000, 1007.812500, 660.750000, 660.187500, 660.187500, 1163.812500, 731.062500, 660.375000, 660.187500, 660.187500, 660.000000, 660.187500, 660.187500, 660.000000, 660.187500, 660.187500, 660.000000, 1059.562500, 661.312500, 660.000000, 660.187500, 660.000000, 1215.375000, 782.812500, 660.187500, 660.000000, 1388.625000, 938.625000, 660.750000, 660.375000, 660.187500, 660.375000, 1111.875000, 661.687500, 660.187500, 660.187500, 1250.437500, 660.375000, 660.187500, 660.375000, 1389.000000, 942.937500, 660.375000, 660.750000, 660.375000, 660.562500, 660.375000, 661.875000, 660.375000, 660.187500, 1250.250000, 660.562500, 660.375000, 660.562500, 660.187500, 1406.062500, 973.500000, 660.937500, 660.000000, 660.187500, 660.375000, 696.562500, 660.750000, 660.000000, 1284.937500, 660.375000, 660.375000, 660.187500, 660.375000, 1423.500000, 990.750000, 660.937500, 660.375000, 660.375000, 1146.750000, 713.437500, 660.562500, 660.375000, 1318.500000, 869.812500, 660.562500, 660.375000, 1042.875000, 661.125000, 660.375000, 660.375000, 660.562500, 1181.250000, 757.312500, 660.375000, 660.562500, 660.187500, 1354.312500, 904.312500, 660.750000, 660.375000, 660.375000, 1077.562500, 660.375000, 660.562500, 660.937500, 660.562500, 1233.375000, 800.812500, 660.562500, 660.562500, 1389.187500, 956.625000, 661.312500, 660.750000, 661.125000, 660.750000, 1115.437500, 696.750000, 660.750000, 660.750000, 1268.437500, 835.312500, 660.937500, 660.562500, 1423.875000, 974.062500, 661.500000, 660.750000, 660.750000, 660.937500, 696.937500, 660.937500, 660.750000, 1302.750000, 870.000000, 660.750000, 660.937500, 660.937500, 660.750000, 1043.062500, 660.750000, 660.750000, 660.937500, 1198.687500, 765.937500, 660.750000, 660.937500, 1372.312500, 939.562500, 661.125000, 660.750000, 660.562500, 660.937500, 1112.437500, 697.125000, 661.125000, 661.125000, 1355.812500, 974.062500, 661.687500, 660.937500, 660.750000, 661.125000, 1250.812500, 835.500000, 661.125000, 660.750000, 660.937500, 1129.687500, 731.625000, 661.312500, 661.125000, 661.125000, 661.125000, 660.937500, 660.937500, 661.500000, 660.937500, 661.125000, 1181.437500, 766.125000, 660.937500, 661.125000, 1341.750000, 904.687500, 661.312500, 661.125000, 660.750000, 1077.937500, 662.062500, 660.937500, 661.312500, 1216.312500, 783.562500, 661.312500, 660.750000, 661.125000, 1372.125000, 939.562500, 661.312500, 661.125000, 661.312500, 661.312500, 1095.562500, 662.437500, 660.937500, 661.312500, 1250.812500, 818.437500, 661.125000, 660.937500, 661.125000, 1423.875000, 973.875000, 661.312500, 661.125000, 660.937500, 660.937500, 1146.937500, 696.937500, 661.125000, 661.125000, 1302.562500, 869.812500, 661.125000, 660.937500, 661.312500, 661.125000, 661.312500, 661.687500, 660.937500, 661.125000, 1181.437500, 749.062500, 660.937500, 660.937500, 1354.875000, 904.687500, 661.125000, 660.937500, 660.937500, 1077.937500, 660.937500, 661.125000, 660.750000, 661.125000, 661.125000, 1268.062500, 835.500000, 661.125000, 661.312500, 1424.250000, 991.312500, 661.687500, 661.125000, 660.937500, 1146.937500, 714.375000, 660.937500, 661.125000, 1320.375000, 870.187500, 661.125000, 661.312500, 661.500000, 661.312500, 1043.437500, 660.937500, 660.937500, 661.125000, 1181.812500, 749.250000, 660.937500, 661.312500, 661.312500, 922.312500, 661.312500, 661.312500, 661.125000, 1060.687500, 662.062500, 660.937500, 661.125000, 1216.125000, 661.125000, 660.937500, 661.125000, 661.312500, 661.125000, 661.125000, 661.312500, 661.312500, 661.125000, 1095.187500, 662.625000, 661.125000, 661.312500, 661.125000, 660.937500, 835.875000, 660.750000, 661.312500, 1424.062500, 661.125000, 974.062500, 661.500000, 661.125000, 660.937500, 1146.750000, 714.187500, 660.937500, 661.125000, 1302.750000, 870.375000, 661.312500, 661.312500, 1026.187500, 661.687500, 660.937500, 661.500000, 661.125000, 661.125000, 731.812500, 661.312500, 661.125000, 661.125000, 1337.437500, 905.062500, 661.125000, 661.125000, 661.312500, 1146.375000, 661.125000, 661.125000, 661.312500, 1215.937500, 783.750000, 661.312500, 661.312500, 1389.750000, 661.312500, 661.125000, 661.312500, 661.125000, 1095.375000, 662.625000, 661.125000, 661.125000, 661.312500, 661.125000, 661.125000, 661.125000, 661.312500, 661.312500, 661.687500, 661.500000, 661.500000, 1112.812500, 679.875000, 661.125000, 661.312500, 1250.812500, 831.750000, 661.500000, 661.500000, 661.312500, 661.875000, 974.250000, 661.875000, 661.312500, 661.500000, 661.500000, 697.500000, 661.312500, 661.500000, 1285.875000, 835.875000, 661.312500, 661.500000, 661.500000, 991.875000, 662.062500, 661.500000, 661.687500, 661.500000, 697.875000, 661.312500, 661.500000, 1286.062500, 853.312500, 661.500000, 661.312500, 1424.437500, 661.500000, 1078.312500, 801.375000}
-
-	mean, stdev := removeOutliers(f)
-	fmt.Printf("%f, %f\n", mean, stdev)
-}